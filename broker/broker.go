@@ -36,6 +36,7 @@ func (b *Broker) Serve(ln net.Listener) error {
 }
 
 func (b *Broker) handleConn(conn net.Conn) {
+	defer conn.Close()
 	key := rand.Int()
 	log.Printf("Connected: %s\n", conn.RemoteAddr())
 	b.storeConn(key, conn)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
@@ -11,79 +12,171 @@ import (
 type bufferConn struct {
 	localAddr  net.Addr
 	remoteAddr net.Addr
+	addrMtx    sync.Mutex // guards remoteAddr, which changes when a client moves
 
 	inBuf  *bytes.Buffer
 	outBuf *bytes.Buffer
 
 	inMtx  sync.Mutex
 	outMtx sync.Mutex
+	inCap  int // Read should drain inBuf before it grows past inCap
+	outCap int // Write blocks while outBuf holds outCap bytes
 
-	inCh     chan struct{}
-	closedCh chan struct{}
+	inCh       chan struct{}
+	outCh      chan struct{}
+	inSpaceCh  chan struct{} // data was read from inBuf
+	outSpaceCh chan struct{} // data was read from outBuf
+	eofCh      chan struct{} // nothing more will be written to inBuf
+	wclosedCh  chan struct{} // nothing more may be written to outBuf
+	rclosedCh  chan struct{} // Read returns io.EOF, data for inBuf is dropped
+	closedCh   chan struct{}
+
+	readDeadline  *deadline
+	writeDeadline *deadline
 }
 
 var _ net.Conn = (*bufferConn)(nil)
 
-func newBufferConn(localAddr, remoteAddr net.Addr) *bufferConn {
+func newBufferConn(localAddr, remoteAddr net.Addr, cfg *connConfig) *bufferConn {
 	return &bufferConn{
 		localAddr:  localAddr,
 		remoteAddr: remoteAddr,
 		inBuf:      bytes.NewBuffer(nil),
 		outBuf:     bytes.NewBuffer(nil),
-		inCh:       make(chan struct{}),
+		inCap:      cfg.recvBufferSize,
+		outCap:     cfg.sendBufferSize,
+		inCh:       make(chan struct{}, 1),
+		outCh:      make(chan struct{}, 1),
+		inSpaceCh:  make(chan struct{}, 1),
+		outSpaceCh: make(chan struct{}, 1),
+		eofCh:      make(chan struct{}),
+		wclosedCh:  make(chan struct{}),
+		rclosedCh:  make(chan struct{}),
 		closedCh:   make(chan struct{}),
+
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
 	}
 }
 
 func (c *bufferConn) Read(b []byte) (n int, err error) {
-	select {
-	case <-c.closedCh:
-		return 0, io.EOF
-	default:
+	for {
+		select {
+		case <-c.closedCh:
+			return 0, io.EOF
+		case <-c.rclosedCh:
+			return 0, io.EOF
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		default:
+		}
 		n, err = c.readInBuf(b)
-		if err == io.EOF {
-			select {
-			case <-c.closedCh:
-				return 0, io.EOF
-			case <-c.inCh:
-				return c.Read(b)
-			}
+		if err != io.EOF {
+			return n, err
+		}
+		select {
+		case <-c.closedCh:
+			return 0, io.EOF
+		case <-c.rclosedCh:
+			return 0, io.EOF
+		case <-c.eofCh:
+			return c.readInBuf(b)
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.inCh:
 		}
-		return n, err
 	}
 }
 
 func (c *bufferConn) readInBuf(b []byte) (int, error) {
 	c.inMtx.Lock()
 	defer c.inMtx.Unlock()
-	return c.inBuf.Read(b)
+	n, err := c.inBuf.Read(b)
+	if n > 0 {
+		signal(c.inSpaceCh)
+	}
+	return n, err
+}
+
+// inBufFree returns the room left in inBuf.
+func (c *bufferConn) inBufFree() int {
+	c.inMtx.Lock()
+	defer c.inMtx.Unlock()
+	if free := c.inCap - c.inBuf.Len(); free > 0 {
+		return free
+	}
+	return 0
+}
+
+// waitInSpace waits until inBuf is below its cap,
+// it returns false if the connection is closed meanwhile.
+func (c *bufferConn) waitInSpace() bool {
+	for c.inBufFree() == 0 {
+		select {
+		case <-c.inSpaceCh:
+		case <-c.closedCh:
+			return false
+		}
+	}
+	return true
 }
 
+// writeInBuf adds data for Read. It never blocks,
+// its callers keep inBuf under inCap, give or take a window of segments.
+// The data is dropped once reading is closed.
 func (c *bufferConn) writeInBuf(b []byte) (n int, err error) {
 	c.inMtx.Lock()
 	defer c.inMtx.Unlock()
-	n, err = c.inBuf.Write(b)
-	select {
-	case c.inCh <- struct{}{}:
-	default:
+	if c.readClosed() {
+		return len(b), nil
 	}
+	n, err = c.inBuf.Write(b)
+	signal(c.inCh)
 	return n, err
 }
 
+// Write blocks while outBuf is full, until the data is sent,
+// the connection is closed or the write deadline is reached.
 func (c *bufferConn) Write(b []byte) (n int, err error) {
-	select {
-	case <-c.closedCh:
-		return 0, io.ErrClosedPipe
-	default:
-		return c.writeOutBuf(b)
+	for {
+		select {
+		case <-c.closedCh:
+			return n, io.ErrClosedPipe
+		case <-c.wclosedCh:
+			return n, io.ErrClosedPipe
+		case <-c.writeDeadline.wait():
+			return n, os.ErrDeadlineExceeded
+		default:
+		}
+		n += c.writeOutBuf(b[n:])
+		if n == len(b) {
+			return n, nil
+		}
+		select {
+		case <-c.closedCh:
+		case <-c.wclosedCh:
+		case <-c.writeDeadline.wait():
+		case <-c.outSpaceCh:
+		}
 	}
 }
 
-func (c *bufferConn) writeOutBuf(b []byte) (n int, err error) {
+// writeOutBuf writes as much of b as outBuf has room for.
+func (c *bufferConn) writeOutBuf(b []byte) int {
 	c.outMtx.Lock()
 	defer c.outMtx.Unlock()
-	n, err = c.outBuf.Write(b)
-	return n, err
+	free := c.outCap - c.outBuf.Len()
+	if free <= 0 {
+		return 0
+	}
+	if len(b) > free {
+		b = b[:free]
+	}
+	n, _ := c.outBuf.Write(b)
+	if n > 0 {
+		signal(c.outCh)
+	}
+	return n
 }
 
 func (c *bufferConn) readOutBuf(b []byte) (n int, err error) {
@@ -93,17 +186,78 @@ func (c *bufferConn) readOutBuf(b []byte) (n int, err error) {
 	if err == io.EOF {
 		return 0, nil
 	}
+	if n > 0 {
+		signal(c.outSpaceCh)
+	}
 	return n, err
 }
 
+func (c *bufferConn) outBufLen() int {
+	c.outMtx.Lock()
+	defer c.outMtx.Unlock()
+	return c.outBuf.Len()
+}
+
+// setEOF makes Read return io.EOF once inBuf is drained.
+func (c *bufferConn) setEOF() {
+	select {
+	case <-c.eofCh:
+	default:
+		close(c.eofCh)
+	}
+}
+
+// closeWrite makes Write fail, data already in outBuf is kept.
+func (c *bufferConn) closeWrite() {
+	select {
+	case <-c.wclosedCh:
+	default:
+		close(c.wclosedCh)
+	}
+}
+
+// discardOutBuf drops the data written and not sent yet.
+func (c *bufferConn) discardOutBuf() {
+	c.outMtx.Lock()
+	defer c.outMtx.Unlock()
+	c.outBuf.Reset()
+	signal(c.outSpaceCh)
+}
+
+// closeRead makes Read return io.EOF and drops the data not read yet.
+func (c *bufferConn) closeRead() {
+	c.inMtx.Lock()
+	defer c.inMtx.Unlock()
+	select {
+	case <-c.rclosedCh:
+	default:
+		close(c.rclosedCh)
+		c.inBuf.Reset()
+		signal(c.inSpaceCh)
+	}
+}
+
+func (c *bufferConn) readClosed() bool {
+	select {
+	case <-c.rclosedCh:
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *bufferConn) Close() error {
 	select {
 	case <-c.closedCh:
 		return io.ErrClosedPipe
 	default:
 		close(c.closedCh)
+		c.inMtx.Lock()
 		c.inBuf.Reset()
+		c.inMtx.Unlock()
+		c.outMtx.Lock()
 		c.outBuf.Reset()
+		c.outMtx.Unlock()
 		return nil
 	}
 }
@@ -113,17 +267,43 @@ func (c *bufferConn) LocalAddr() net.Addr {
 }
 
 func (c *bufferConn) RemoteAddr() net.Addr {
+	c.addrMtx.Lock()
+	defer c.addrMtx.Unlock()
 	return c.remoteAddr
 }
 
+func (c *bufferConn) setRemoteAddr(addr net.Addr) {
+	c.addrMtx.Lock()
+	defer c.addrMtx.Unlock()
+	c.remoteAddr = addr
+}
+
+// SetDeadline implements net.Conn.
+// Calls past the deadline fail with os.ErrDeadlineExceeded,
+// which is a net.Error reporting a timeout.
 func (c *bufferConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
 	return nil
 }
 
+// SetReadDeadline implements net.Conn.
 func (c *bufferConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
 	return nil
 }
 
+// SetWriteDeadline implements net.Conn.
 func (c *bufferConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
 	return nil
 }
+
+// signal wakes up the goroutine waiting on ch, if any.
+// ch has a buffer of one, so a signal sent with nobody waiting is kept.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -1,99 +1,80 @@
 package icmpnet
 
 import (
-	"math/rand"
+	"context"
+	"crypto/aes"
 	"net"
-
-	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 )
 
-type client struct {
-	pconn       *icmp.PacketConn
-	conn        *icmpConn
-	closedCh    chan struct{}
-	connectedCh chan struct{}
-}
-
 // Connect create a connection to server.
+// ICMPv6 is used if server is an IPv6 address.
+// If a raw socket is not permitted, an unprivileged ping socket is used,
+// which on linux requires the group of the user in net.ipv4.ping_group_range.
 // If aesKey is nil, encryption is disabled.
 func Connect(server net.Addr, aesKey []byte) (net.Conn, error) {
-	pconn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
-	if err != nil {
-		return nil, err
-	}
-	c := &client{
-		pconn:       pconn,
-		connectedCh: make(chan struct{}, 1),
-	}
-	go c.mainLoop()
+	dc := &DialConfig{AESKey: aesKey}
+	return dc.dial(context.Background(), server, server.String(), dc.connConfig())
+}
 
-	c.conn = newICMPClientConn(c, rand.Int(), server)
-	<-c.connectedCh
+// Dial connects to the server at address, a host name or an IP address.
+func (dc *DialConfig) Dial(address string) (net.Conn, error) {
+	return dc.DialContext(context.Background(), address)
+}
+
+// DialContext connects to the server at address, a host name or an IP address.
+// If ctx is done before the connection is open, the dial is aborted.
+// Once the connection is open, ctx has no effect on it.
+// The error returned is a *DialError.
+func (dc *DialConfig) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	return dc.dialContext(ctx, address, dc.connConfig())
+}
 
-	if aesKey == nil {
-		return c.conn, nil
+func (dc *DialConfig) dialContext(ctx context.Context, address string, cfg *connConfig) (net.Conn, error) {
+	if dc.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dc.Timeout)
+		defer cancel()
 	}
-	return newSecureConn(c.conn, aesKey)
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, address)
+	if err != nil {
+		return nil, &DialError{Addr: address, Err: err}
+	}
+	return dc.dial(ctx, &addrs[0], address, cfg)
 }
 
-func (c *client) mainLoop() {
-	buf := make([]byte, 5000)
-	connected := false
-	for {
-		select {
-		case <-c.closedCh:
-			return
-		default:
-			n, addr, err := c.pconn.ReadFrom(buf)
-			if err != nil {
-				panic(err)
-			}
-			msg, err := icmp.ParseMessage(1, buf[:n])
-			if err != nil {
-				continue
-			}
-			if msg.Type != ipv4.ICMPTypeEchoReply {
-				continue
-			}
-			if addr.String() != c.conn.RemoteAddr().String() {
-				continue
-			}
-			msg, err = icmp.ParseMessage(1, buf[:n])
-			if err != nil {
-				continue
-			}
-			if body, ok := msg.Body.(*icmp.Echo); ok {
-				if body.ID != c.conn.ID() {
-					continue
-				}
-				if !connected {
-					connected = true
-					c.connectedCh <- struct{}{}
-				}
-				c.conn.readCh <- msg
-			}
+func (dc *DialConfig) dial(ctx context.Context, server net.Addr, address string, cfg *connConfig) (net.Conn, error) {
+	// verify aesKey
+	if dc.AESKey != nil {
+		if _, err := aes.NewCipher(dc.AESKey); err != nil {
+			return nil, &DialError{Addr: address, Err: err}
 		}
 	}
+	sock, err := acquireSocket(familyOf(server))
+	if err != nil {
+		return nil, &DialError{Addr: address, Err: err}
+	}
+	conn, err := dc.open(ctx, sock, server, cfg)
+	if err != nil {
+		return nil, &DialError{Addr: address, Err: err}
+	}
+	return conn, nil
 }
 
-func (c *client) localAddr() net.Addr {
-	return c.pconn.LocalAddr()
-}
+// open opens a session with server through sock.
+func (dc *DialConfig) open(ctx context.Context, sock *clientSocket, server net.Addr, cfg *connConfig) (net.Conn, error) {
+	conn := newICMPClientConn(sock, sock.id, server, dc.AESKey, cfg)
+	sock.add(conn)
+	go conn.clientLoop()
 
-func (c *client) onConnClose(conn *icmpConn) {
 	select {
-	case <-c.closedCh:
-	default:
-		close(c.closedCh)
+	case <-conn.openCh:
+	case <-conn.doneCh:
+		return nil, conn.err
+	case <-ctx.Done():
+		conn.fail(ctx.Err())
+		<-conn.doneCh
+		return nil, conn.err
 	}
-}
 
-func (c *client) sendMsg(msg *icmp.Message, addr net.Addr) error {
-	b, err := msg.Marshal(nil)
-	if err != nil {
-		return err
-	}
-	_, err = c.pconn.WriteTo(b, addr)
-	return err
+	return wrapConn(conn, dc.AESKey, cfg)
 }
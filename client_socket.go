@@ -0,0 +1,250 @@
+package icmpnet
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+
+	"golang.org/x/net/icmp"
+)
+
+// clientSocket is the ICMP socket shared by the client connections
+// of the process for one address family. It sends every request
+// with the same echo id and routes the replies to the connections
+// by server and session, or by client nonce during the handshake.
+type clientSocket struct {
+	family *icmpFamily
+	pconn  net.PacketConn
+	dgram  bool
+	id     int
+
+	conns map[sessionKey]*icmpConn
+	syns  map[string]*icmpConn
+	all   map[*icmpConn]struct{}
+	refs  int
+	mtx   sync.Mutex
+
+	closedCh chan struct{}
+}
+
+type sessionKey struct {
+	server  string
+	session uint32
+}
+
+func newSessionKey(addr net.Addr, session uint32) sessionKey {
+	return sessionKey{addrIP(addr).String(), session}
+}
+
+var (
+	sockets    = make(map[*icmpFamily]*clientSocket)
+	socketsMtx sync.Mutex
+)
+
+// acquireSocket returns the socket of family, opened if needed,
+// holding a reference released once a connection is closed.
+func acquireSocket(f *icmpFamily) (*clientSocket, error) {
+	socketsMtx.Lock()
+	defer socketsMtx.Unlock()
+	if sock := sockets[f]; sock != nil {
+		sock.refs++
+		return sock, nil
+	}
+	pconn, dgram, err := listenClient(f)
+	if err != nil {
+		return nil, err
+	}
+	id := rand.Intn(1 << 16)
+	if dgram {
+		// the kernel assigns the echo id of a ping socket
+		// and only delivers the replies matching it
+		id = pconn.LocalAddr().(*net.UDPAddr).Port
+	}
+	sock := newClientSocket(f, pconn, dgram, id)
+	sockets[f] = sock
+	go sock.mainLoop()
+	return sock, nil
+}
+
+func newClientSocket(f *icmpFamily, pconn net.PacketConn, dgram bool, id int) *clientSocket {
+	return &clientSocket{
+		family:   f,
+		pconn:    pconn,
+		dgram:    dgram,
+		id:       id,
+		conns:    make(map[sessionKey]*icmpConn),
+		syns:     make(map[string]*icmpConn),
+		all:      make(map[*icmpConn]struct{}),
+		refs:     1,
+		closedCh: make(chan struct{}),
+	}
+}
+
+// release drops a reference to the socket and closes it with the last one.
+func (sock *clientSocket) release() {
+	socketsMtx.Lock()
+	defer socketsMtx.Unlock()
+	sock.refs--
+	if sock.refs > 0 {
+		return
+	}
+	if sockets[sock.family] == sock {
+		delete(sockets, sock.family)
+	}
+	close(sock.closedCh)
+	sock.pconn.Close()
+}
+
+// listenClient opens a raw icmp socket,
+// or a ping socket if the process is not allowed to open a raw one.
+func listenClient(f *icmpFamily) (*icmp.PacketConn, bool, error) {
+	pconn, err := icmp.ListenPacket(f.network, f.address)
+	if err == nil {
+		return pconn, false, nil
+	}
+	pconn, derr := icmp.ListenPacket(f.dgramNetwork, f.address)
+	if derr != nil {
+		return nil, false, err
+	}
+	return pconn, true, nil
+}
+
+func (sock *clientSocket) mainLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := sock.pconn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-sock.closedCh:
+			default:
+				sock.fail(err)
+			}
+			return
+		}
+		msg, err := icmp.ParseMessage(sock.family.protocol, buf[:n])
+		if err != nil {
+			continue
+		}
+		if msg.Type == sock.family.unreachable && !sock.dgram {
+			dst, id, ok := sock.family.unreachableEcho(msg)
+			if ok && id == sock.id {
+				sock.unreachable(dst)
+			}
+			continue
+		}
+		if msg.Type != sock.family.echoReply {
+			continue
+		}
+		body, ok := msg.Body.(*icmp.Echo)
+		if !ok || body.ID != sock.id {
+			continue
+		}
+		p, err := parsePacket(body.Data, magicReply)
+		if err != nil && err != errOtherVersion {
+			// a RST of another version is routed to the handshake it rejects
+			continue
+		}
+		conn := sock.route(addr, p)
+		if conn == nil {
+			continue
+		}
+		select {
+		case conn.readCh <- msg:
+		default:
+			// a connection slow to read its packets
+			// must not hold up the others
+		}
+	}
+}
+
+// route returns the connection a reply is for.
+// The session of a handshake reply is learnt from it.
+func (sock *clientSocket) route(addr net.Addr, p *packet) *icmpConn {
+	sock.mtx.Lock()
+	defer sock.mtx.Unlock()
+	if conn := sock.conns[newSessionKey(addr, p.session)]; conn != nil {
+		return conn
+	}
+	if (p.typ != typeSyn && p.typ != typeRst) || len(p.data) < nonceSize {
+		return nil
+	}
+	conn := sock.syns[synKey(addr, p.data[:nonceSize])]
+	if conn != nil && p.typ == typeSyn {
+		sock.conns[newSessionKey(addr, p.session)] = conn
+	}
+	return conn
+}
+
+// add registers a connection before its handshake is sent.
+func (sock *clientSocket) add(conn *icmpConn) {
+	sock.mtx.Lock()
+	defer sock.mtx.Unlock()
+	sock.syns[synKey(conn.RemoteAddr(), conn.clientNonce)] = conn
+	sock.all[conn] = struct{}{}
+}
+
+func (sock *clientSocket) remove(conn *icmpConn) {
+	sock.mtx.Lock()
+	defer sock.mtx.Unlock()
+	delete(sock.syns, synKey(conn.RemoteAddr(), conn.clientNonce))
+	// the session may have been learnt from a reply the connection never read
+	for key, c := range sock.conns {
+		if c == conn {
+			delete(sock.conns, key)
+		}
+	}
+	delete(sock.all, conn)
+}
+
+// unreachable fails the connections to dst not open yet.
+func (sock *clientSocket) unreachable(dst net.IP) {
+	for _, conn := range sock.allConns() {
+		if addrIP(conn.RemoteAddr()).Equal(dst) {
+			conn.unreachable()
+		}
+	}
+}
+
+// fail ends every connection once the socket can not be read anymore.
+// New connections get a socket of their own.
+func (sock *clientSocket) fail(err error) {
+	socketsMtx.Lock()
+	if sockets[sock.family] == sock {
+		delete(sockets, sock.family)
+	}
+	socketsMtx.Unlock()
+	for _, conn := range sock.allConns() {
+		conn.fail(err)
+	}
+}
+
+func (sock *clientSocket) allConns() []*icmpConn {
+	sock.mtx.Lock()
+	defer sock.mtx.Unlock()
+	ret := make([]*icmpConn, 0, len(sock.all))
+	for conn := range sock.all {
+		ret = append(ret, conn)
+	}
+	return ret
+}
+
+func (sock *clientSocket) localAddr(f *icmpFamily) net.Addr {
+	return sock.pconn.LocalAddr()
+}
+
+func (sock *clientSocket) onConnClose(conn *icmpConn) {
+	sock.remove(conn)
+	sock.release()
+}
+
+func (sock *clientSocket) sendMsg(msg *icmp.Message, addr net.Addr) error {
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if sock.dgram {
+		addr = &net.UDPAddr{IP: addrIP(addr)}
+	}
+	_, err = sock.pconn.WriteTo(b, addr)
+	return err
+}
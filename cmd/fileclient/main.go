@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"flag"
 	"fmt"
@@ -29,35 +30,53 @@ func showProgress() endProgressFunc {
 	return func() { close(end) }
 }
 
-func uploadFile(client *rpc.Client) {
+func askFileName(prompt string) string {
 	var filename string
-	fmt.Print("Enter file path >>  ")
+	fmt.Printf("Enter %s >>  ", prompt)
 	fmt.Scanln(&filename)
+	return filename
+}
 
+func uploadFile(client *rpc.Client, filename string) error {
 	endP := showProgress()
 	err := client.FileUpload(filename)
 	endP()
-	check(err)
+	if err != nil {
+		return err
+	}
 
 	fmt.Print("\n\n")
 	fmt.Println("File upload successful!")
+	return nil
 }
 
-func downloadFile(client *rpc.Client) {
-	var filename string
-	fmt.Print("Enter file name >>  ")
-	fmt.Scanln(&filename)
-
+func downloadFile(client *rpc.Client, filename string) error {
 	dir, err := os.Getwd()
 	check(err)
 
 	endP := showProgress()
 	err = client.FileDownload(filename, dir)
 	endP()
-	check(err)
+	if err != nil {
+		return err
+	}
 
 	fmt.Print("\n\n")
 	fmt.Println("File download successful!")
+	return nil
+}
+
+func printState(serverIP string) func(icmpnet.ConnState, error) {
+	return func(state icmpnet.ConnState, err error) {
+		switch state {
+		case icmpnet.StateConnecting:
+			fmt.Printf("Connecting: %s ...\n", serverIP)
+		case icmpnet.StateResuming:
+			fmt.Print("\nNo reply from server, waiting for the network ...")
+		case icmpnet.StateDisconnected:
+			fmt.Printf("\nDisconnected: %v\n", err)
+		}
+	}
 }
 
 func main() {
@@ -67,6 +86,7 @@ func main() {
 		inputServerIP string
 		inputPassword string
 		mode          int
+		filename      string
 	)
 	flag.StringVar(&serverIP, "server", "13.212.27.85", "server ip address")
 	flag.StringVar(&password, "pw", "password", "password")
@@ -87,31 +107,46 @@ func main() {
 	sum := sha256.Sum256([]byte(password))
 	aesKey := sum[:]
 
-	addr, err := net.ResolveIPAddr("ip4", serverIP)
-	check(err)
-
-	fmt.Printf("Connecting: %s ...\n", addr)
-	conn, err := icmpnet.Connect(addr, aesKey)
-	check(err)
-
-	rpcClient := rpc.NewClient(conn)
-
-	vInfo, err := rpcClient.InfoVersion()
-	if err == nil {
-		fmt.Println(vInfo)
+	rc := &icmpnet.Reconnector{
+		Dialer:  &icmpnet.DialConfig{AESKey: aesKey, ResumeTimeout: time.Minute, Compress: true},
+		Address: serverIP,
+		OnState: printState(serverIP),
 	}
+	err := rc.Run(context.Background(), func(conn net.Conn) error {
+		rpcClient := rpc.NewClient(conn)
 
-	fmt.Print("Select mode Upload = 1, Download = 2 >>  ")
-	fmt.Scanln(&mode)
-	switch mode {
-	case 1:
-		uploadFile(rpcClient)
-	case 2:
-		downloadFile(rpcClient)
-	default:
-		fmt.Println("Unknown mode")
-	}
+		vInfo, err := rpcClient.InfoVersion()
+		if err == nil {
+			fmt.Println(vInfo)
+		}
 
+		if mode == 0 {
+			fmt.Print("Select mode Upload = 1, Download = 2 >>  ")
+			fmt.Scanln(&mode)
+		}
+		switch mode {
+		case 1:
+			if filename == "" {
+				filename = askFileName("file path")
+			}
+			err = uploadFile(rpcClient, filename)
+		case 2:
+			if filename == "" {
+				filename = askFileName("file name")
+			}
+			err = downloadFile(rpcClient, filename)
+		default:
+			fmt.Println("Unknown mode")
+			return nil
+		}
+		if rpc.ConnLost(err) {
+			// the transfer starts over on a new connection
+			return err
+		}
+		check(err)
+		return nil
+	})
+	check(err)
 }
 
 func check(err error) {
@@ -4,8 +4,10 @@ import (
 	"crypto/sha256"
 	"flag"
 	"fmt"
+	"time"
 
 	"github.com/aungmawjj/icmpnet"
+	"github.com/aungmawjj/icmpnet/cmd/internal/shutdown"
 	"github.com/aungmawjj/icmpnet/rpc"
 )
 
@@ -14,15 +16,32 @@ func main() {
 		password string
 		dirPath  string
 	)
+	var noEcho bool
 	flag.StringVar(&password, "pw", "password", "password")
+	flag.BoolVar(&noEcho, "noecho", true, "stop the kernel answering pings while serving")
 	flag.StringVar(&dirPath, "dir", "uploaded_files", "directory for uploaded files")
 	flag.Parse()
 
 	sum := sha256.Sum256([]byte(password))
 	aesKey := sum[:]
 
-	ln, err := icmpnet.Listen(aesKey)
+	lc := &icmpnet.ListenConfig{
+		AESKey:            aesKey,
+		DisableKernelEcho: noEcho,
+		ResumeTimeout:     time.Minute,
+		Compress:          true,
+
+		// a server open to anyone answering pings
+		MaxSessions:      1000,
+		MaxSessionsPerIP: 10,
+		SessionRate:      2,
+		SessionBurst:     10,
+		// file transfers, a few MiB/s per session
+		PacketRate: 5000,
+	}
+	ln, err := lc.Listen()
 	check(err)
+	shutdown.CloseOnSignal(ln)
 
 	welcome := fmt.Sprintf("File server [ icmpnet ] %s\n", icmpnet.Version)
 	rpcServer := rpc.NewServer(welcome, dirPath)
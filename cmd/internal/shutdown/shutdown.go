@@ -0,0 +1,36 @@
+// Package shutdown stops the sample servers on a signal.
+package shutdown
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// timeout bounds the wait for the sessions to close
+const timeout = 10 * time.Second
+
+// CloseOnSignal closes ln on interrupt, which restores the kernel settings.
+func CloseOnSignal(ln net.Listener) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		// a second signal kills the server right away
+		signal.Stop(sigCh)
+		done := make(chan struct{})
+		go func() {
+			ln.Close()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			fmt.Println("Timed out closing connections")
+		}
+		os.Exit(0)
+	}()
+}
@@ -9,11 +9,14 @@ import (
 
 	"github.com/aungmawjj/icmpnet"
 	"github.com/aungmawjj/icmpnet/broker"
+	"github.com/aungmawjj/icmpnet/cmd/internal/shutdown"
 )
 
 func main() {
 	var password string
+	var noEcho bool
 	flag.StringVar(&password, "pw", "password", "password")
+	flag.BoolVar(&noEcho, "noecho", true, "stop the kernel answering pings while serving")
 	flag.Parse()
 
 	sum := sha256.Sum256([]byte(password))
@@ -21,8 +24,23 @@ func main() {
 
 	rand.Seed(time.Now().UnixNano())
 
-	ln, err := icmpnet.Listen(aesKey)
+	lc := &icmpnet.ListenConfig{
+		AESKey:            aesKey,
+		DisableKernelEcho: noEcho,
+		ResumeTimeout:     time.Minute,
+		Compress:          true,
+
+		// a server open to anyone answering pings
+		MaxSessions:      1000,
+		MaxSessionsPerIP: 10,
+		SessionRate:      2,
+		SessionBurst:     10,
+		// short messages, and the polls of idle clients
+		PacketRate: 500,
+	}
+	ln, err := lc.Listen()
 	check(err)
+	shutdown.CloseOnSignal(ln)
 
 	welcome := fmt.Sprintf("Message Broker [ icmpnet ] %s\n", icmpnet.Version)
 	b := broker.New(welcome)
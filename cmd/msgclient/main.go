@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha256"
 	"flag"
 	"fmt"
@@ -13,22 +14,63 @@ import (
 	"github.com/aungmawjj/icmpnet"
 )
 
-func printIncoming(conn net.Conn) {
+func printIncoming(conn net.Conn) error {
 	r := bufio.NewReader(conn)
 	for {
 		msg, err := r.ReadString('\n')
-		check(err)
+		if err != nil {
+			return err
+		}
 		fmt.Printf(">> %s\n", msg)
 	}
 }
 
-func sendMessages(conn net.Conn, nickName string) {
+// readMessages reads the lines typed by the user, they are kept
+// until sent while the client is reconnecting.
+func readMessages(lines chan<- string) {
+	defer close(lines)
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		msg, err := reader.ReadString('\n')
-		check(err)
-		_, err = fmt.Fprintf(conn, "[ %s ] >>  %s", nickName, msg)
-		check(err)
+		if err != nil {
+			return
+		}
+		lines <- msg
+	}
+}
+
+// chat runs a session with the broker until the connection fails,
+// or the user is done typing.
+func chat(conn net.Conn, lines <-chan string, nickName string) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- printIncoming(conn) }()
+	for {
+		select {
+		case msg, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			if _, err := fmt.Fprintf(conn, "[ %s ] >>  %s", nickName, msg); err != nil {
+				return err
+			}
+		case err := <-errCh:
+			return err
+		}
+	}
+}
+
+func printState(serverIP string) func(icmpnet.ConnState, error) {
+	return func(state icmpnet.ConnState, err error) {
+		switch state {
+		case icmpnet.StateConnecting:
+			fmt.Printf("Connecting: %s ...\n", serverIP)
+		case icmpnet.StateConnected:
+			fmt.Print("Connected!\n\n")
+		case icmpnet.StateResuming:
+			fmt.Println("No reply from server, waiting for the network ...")
+		case icmpnet.StateDisconnected:
+			fmt.Printf("Disconnected: %v\n", err)
+		}
 	}
 }
 
@@ -67,19 +109,20 @@ func main() {
 	sum := sha256.Sum256([]byte(password))
 	aesKey := sum[:]
 
-	addr, err := net.ResolveIPAddr("ip4", serverIP)
-	check(err)
-
 	rand.Seed(time.Now().UnixNano()) // to generate random client id
 
-	fmt.Printf("Connecting: %s ...\n", addr)
-	conn, err := icmpnet.Connect(addr, aesKey)
-	check(err)
-	fmt.Print("Connected!\n\n")
+	lines := make(chan string)
+	go readMessages(lines)
 
-	go printIncoming(conn)
-	go sendMessages(conn, username)
-	select {}
+	rc := &icmpnet.Reconnector{
+		Dialer:  &icmpnet.DialConfig{AESKey: aesKey, ResumeTimeout: time.Minute, Compress: true},
+		Address: serverIP,
+		OnState: printState(serverIP),
+	}
+	err := rc.Run(context.Background(), func(conn net.Conn) error {
+		return chat(conn, lines, username)
+	})
+	check(err)
 }
 
 func check(err error) {
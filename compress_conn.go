@@ -0,0 +1,86 @@
+package icmpnet
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// compressConn compresses the stream of its base connection with DEFLATE.
+// The compressor is flushed after each chunk written, so that the peer
+// can read it without waiting for more, and keeps its dictionary
+// from one chunk to the next.
+type compressConn struct {
+	layerConn
+
+	// stream bytes, accessed atomically
+	written  uint64 // written by the application
+	sent     uint64 // sent compressed to the base connection
+	received uint64 // received compressed from the base connection
+	read     uint64 // decompressed for the application
+}
+
+func newCompressConn(baseConn net.Conn, cfg *connConfig) *compressConn {
+	cc := &compressConn{
+		layerConn: *newLayerConn(baseConn, cfg),
+	}
+	// the final block of zw makes the peer read io.EOF
+	zw, _ := flate.NewWriter(&countWriter{w: baseConn, n: &cc.sent}, flate.DefaultCompression)
+	go cc.readLoop()
+	go cc.writeLoop(func(b []byte) error {
+		atomic.AddUint64(&cc.written, uint64(len(b)))
+		if _, err := zw.Write(b); err != nil {
+			return err
+		}
+		return zw.Flush()
+	}, zw.Close)
+	return cc
+}
+
+func (cc *compressConn) readLoop() {
+	defer cc.setEOF()
+
+	zr := flate.NewReader(&countReader{r: cc.baseConn, n: &cc.received})
+	buf := make([]byte, 32768)
+	for {
+		n, err := zr.Read(buf)
+		if n > 0 {
+			if !cc.deliver(buf[:n]) {
+				return
+			}
+			atomic.AddUint64(&cc.read, uint64(n))
+		}
+		if _, corrupt := err.(flate.CorruptInputError); corrupt {
+			cc.baseConn.Close()
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// countReader counts the bytes read from r in *n, atomically.
+type countReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (cr *countReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	atomic.AddUint64(cr.n, uint64(n))
+	return n, err
+}
+
+// countWriter counts the bytes written to w in *n, atomically.
+type countWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	atomic.AddUint64(cw.n, uint64(n))
+	return n, err
+}
@@ -0,0 +1,272 @@
+package icmpnet
+
+import (
+	"time"
+)
+
+// ListenConfig contains options for listening to connections.
+// A zero field takes its default value.
+type ListenConfig struct {
+	// AESKey enables encryption if not nil.
+	AESKey []byte
+
+	// DisableKernelEcho makes the kernel ignore pings (only on linux,
+	// where it needs root) until the listener is closed.
+	// Ordinary pings are answered by the listener whenever the kernel
+	// ignores them, so that the server can still be pinged.
+	DisableKernelEcho bool
+
+	// IdleTimeout is how long a connection waits for the next packet
+	// of its client before it considers it gone. It is raised on paths
+	// slow enough to need it. The default is 5 seconds.
+	IdleTimeout time.Duration
+
+	// ResumeTimeout is how long the session of a client gone quiet
+	// for IdleTimeout is parked, with the data not yet delivered,
+	// before it is closed. A client coming back within it, even from
+	// another address, resumes the connection where it stopped.
+	// Zero disables it.
+	ResumeTimeout time.Duration
+
+	// Compress lets the clients asking for it compress the stream
+	// of their connection, see DialConfig.Compress.
+	Compress bool
+
+	// MaxPayloadSize is the largest echo payload a client may choose.
+	// The default is the largest size of an ICMP datagram.
+	MaxPayloadSize int
+
+	// AcceptBacklog is the number of new connections
+	// waiting for Accept, clients beyond it are rejected
+	// with ErrServerBusy. The default is 100.
+	AcceptBacklog int
+
+	// MaxSessions is the number of sessions open at once, clients
+	// beyond it are rejected with ErrServerBusy. Zero means no limit.
+	MaxSessions int
+
+	// MaxSessionsPerIP is the number of sessions open at once from one
+	// address, clients beyond it are rejected with ErrTooManySessions.
+	// Zero means no limit.
+	MaxSessionsPerIP int
+
+	// SessionRate is the number of sessions an address may open
+	// per second, in bursts of up to SessionBurst. Handshakes beyond it
+	// are dropped and retried by the client, as are the handshakes of new
+	// addresses while 65536 others are tracked. Zero means no limit,
+	// the default burst is a second worth of sessions.
+	SessionRate  float64
+	SessionBurst int
+
+	// PacketRate is the number of packets a session may send
+	// per second, in bursts of up to PacketBurst. Packets beyond it
+	// are dropped as if lost. Zero means no limit,
+	// the default burst is a second worth of packets.
+	PacketRate  float64
+	PacketBurst int
+
+	// ReadQueueSize is the number of packets queued for a connection
+	// until it handles them, packets beyond it are dropped as if lost.
+	// The default is 100.
+	ReadQueueSize int
+
+	// SendBufferSize is the number of bytes written to a connection
+	// and not sent yet above which Write blocks. The default is 256 KiB.
+	SendBufferSize int
+
+	// RecvBufferSize is the number of bytes received by a connection
+	// and not read yet above which the client is told to stop sending.
+	// The default is 256 KiB.
+	RecvBufferSize int
+
+	// Logf, if not nil, logs the events of the listener
+	// and its connections.
+	Logf func(format string, args ...interface{})
+}
+
+// DialConfig contains options for connecting to a server.
+// A zero field takes its default value.
+type DialConfig struct {
+	// AESKey enables encryption if not nil,
+	// the server must be listening with the same key.
+	AESKey []byte
+
+	// Timeout is the maximum amount of time a dial waits for the server
+	// to accept the connection, zero means no timeout.
+	// A dial gives up anyway when the server does not answer
+	// after a few retransmissions.
+	Timeout time.Duration
+
+	// IdleTimeout is how long a connection waits for a reply
+	// from the server before it considers it gone. It is raised on paths
+	// slow enough to need it. The default is 5 seconds.
+	IdleTimeout time.Duration
+
+	// ResumeTimeout is how long the connection keeps trying to reach
+	// the server once it got no reply for IdleTimeout, before it fails
+	// with ErrNoReply, so that it survives an outage of the network.
+	// The server must park the session as long, see
+	// ListenConfig.ResumeTimeout. Zero disables it.
+	ResumeTimeout time.Duration
+
+	// Compress asks for the stream to be compressed with DEFLATE
+	// before it is encrypted, which saves bandwidth on text and other
+	// compressible data. It is done if the listener lets it,
+	// the Stats of the connection tell whether it is.
+	Compress bool
+
+	// PayloadSize is the largest echo payload tried at connect time.
+	// The default is the PayloadSize variable.
+	PayloadSize int
+
+	// PollCount is the number of empty requests kept at the server.
+	// The default is the PollCount variable.
+	PollCount int
+
+	// ReadQueueSize is the number of packets queued for the connection
+	// until it handles them. The default is 100.
+	ReadQueueSize int
+
+	// SendBufferSize is the number of bytes written to the connection
+	// and not sent yet above which Write blocks. The default is 256 KiB.
+	SendBufferSize int
+
+	// RecvBufferSize is the number of bytes received by the connection
+	// and not read yet above which the server is told to stop sending.
+	// The default is 256 KiB.
+	RecvBufferSize int
+
+	// Logf, if not nil, logs the events of the connection.
+	Logf func(format string, args ...interface{})
+}
+
+// Dialer is the DialConfig used to dial.
+type Dialer = DialConfig
+
+const (
+	defaultAcceptBacklog = 100
+	defaultReadQueueSize = 100
+	defaultBufferSize    = 256 << 10
+)
+
+// connConfig holds the options of a connection,
+// taken from a ListenConfig or a DialConfig.
+type connConfig struct {
+	idleTimeout    time.Duration
+	resumeTimeout  time.Duration
+	payloadSize    int
+	maxPayloadSize int
+	pollCount      int
+	readQueueSize  int
+	sendBufferSize int
+	recvBufferSize int
+	logf           func(format string, args ...interface{})
+	onState        func(ConnState) // told when a client connection resumes, see Reconnector
+	options        uint8           // asked by a client or allowed by a listener, see session.go
+}
+
+func (lc *ListenConfig) connConfig() *connConfig {
+	cfg := &connConfig{
+		idleTimeout:    lc.IdleTimeout,
+		resumeTimeout:  lc.ResumeTimeout,
+		options:        optionsOf(lc.Compress),
+		payloadSize:    minPayloadSize,
+		maxPayloadSize: lc.MaxPayloadSize,
+		readQueueSize:  lc.ReadQueueSize,
+		sendBufferSize: lc.SendBufferSize,
+		recvBufferSize: lc.RecvBufferSize,
+		logf:           lc.Logf,
+	}
+	return cfg.withDefaults()
+}
+
+func (dc *DialConfig) connConfig() *connConfig {
+	cfg := &connConfig{
+		idleTimeout:    dc.IdleTimeout,
+		resumeTimeout:  dc.ResumeTimeout,
+		options:        optionsOf(dc.Compress),
+		payloadSize:    dc.PayloadSize,
+		maxPayloadSize: maxPayloadSize,
+		pollCount:      dc.PollCount,
+		readQueueSize:  dc.ReadQueueSize,
+		sendBufferSize: dc.SendBufferSize,
+		recvBufferSize: dc.RecvBufferSize,
+		logf:           dc.Logf,
+	}
+	if cfg.payloadSize == 0 {
+		cfg.payloadSize = PayloadSize
+	}
+	if cfg.pollCount == 0 {
+		cfg.pollCount = PollCount
+	}
+	if cfg.pollCount < 1 {
+		cfg.pollCount = 1
+	}
+	return cfg.withDefaults()
+}
+
+func (cfg *connConfig) withDefaults() *connConfig {
+	if cfg.idleTimeout <= 0 {
+		cfg.idleTimeout = idleTimeout
+	}
+	if cfg.resumeTimeout < 0 {
+		cfg.resumeTimeout = 0
+	}
+	if cfg.maxPayloadSize <= 0 || cfg.maxPayloadSize > maxPayloadSize {
+		cfg.maxPayloadSize = maxPayloadSize
+	}
+	if cfg.maxPayloadSize < minPayloadSize {
+		cfg.maxPayloadSize = minPayloadSize
+	}
+	if cfg.payloadSize < minPayloadSize {
+		cfg.payloadSize = minPayloadSize
+	}
+	if cfg.payloadSize > cfg.maxPayloadSize {
+		cfg.payloadSize = cfg.maxPayloadSize
+	}
+	if cfg.readQueueSize <= 0 {
+		cfg.readQueueSize = defaultReadQueueSize
+	}
+	if cfg.sendBufferSize <= 0 {
+		cfg.sendBufferSize = defaultBufferSize
+	}
+	if cfg.recvBufferSize <= 0 {
+		cfg.recvBufferSize = defaultBufferSize
+	}
+	if cfg.recvBufferSize < cfg.maxPayloadSize {
+		// room for at least one segment of the largest size
+		cfg.recvBufferSize = cfg.maxPayloadSize
+	}
+	return cfg
+}
+
+func (cfg *connConfig) log(format string, args ...interface{}) {
+	if cfg.logf != nil {
+		cfg.logf(format, args...)
+	}
+}
+
+func (cfg *connConfig) state(state ConnState) {
+	if cfg.onState != nil {
+		cfg.onState(state)
+	}
+}
+
+// optionsOf returns the session options for the fields of a config.
+func optionsOf(compress bool) uint8 {
+	if compress {
+		return optCompress
+	}
+	return 0
+}
+
+// burstOf returns burst, or a second worth of rate if not set.
+func burstOf(rate float64, burst int) int {
+	if burst > 0 {
+		return burst
+	}
+	if rate < 1 {
+		return 1
+	}
+	return int(rate)
+}
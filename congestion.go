@@ -0,0 +1,136 @@
+package icmpnet
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	initialCwnd = 4
+	minSsthresh = 2
+	lossBackoff = 0.7 // as in CUBIC, halving is too much on lossy radio links
+	paceBurst   = 2   // segments that may go out ahead of the pacing
+)
+
+// congestion limits the number of data segments in flight to cwnd,
+// and paces them over the round trip time instead of sending them at once.
+// cwnd grows AIMD style (RFC 5681): by one segment per segment acknowledged
+// up to ssthresh, then by one segment per window. A loss found by the sacks
+// cuts it by lossBackoff, at most once per window, and a retransmission
+// timeout brings it down to one segment.
+// It is safe for concurrent use, so that Stats can read it.
+type congestion struct {
+	mtx         sync.Mutex
+	cwnd        float64
+	ssthresh    float64
+	recovering  bool
+	recoverSeq  uint32 // segments before it were sent before the last loss
+	lastTimeout time.Time
+	nextSend    time.Time
+	interval    time.Duration
+}
+
+func newCongestion() *congestion {
+	return &congestion{
+		cwnd:     initialCwnd,
+		ssthresh: windowSize,
+	}
+}
+
+// window returns the number of segments that may be in flight.
+func (c *congestion) window() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return int(c.cwnd)
+}
+
+// onAck grows the window by the number of segments newly acknowledged,
+// unless the losses of the last window are still being recovered.
+func (c *congestion) onAck(ack uint32, acked int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.recovering {
+		if seqBefore(ack, c.recoverSeq) {
+			return
+		}
+		c.recovering = false
+	}
+	for i := 0; i < acked; i++ {
+		if c.cwnd < c.ssthresh {
+			c.cwnd++
+		} else {
+			c.cwnd += 1 / c.cwnd
+		}
+	}
+	if c.cwnd > windowSize {
+		c.cwnd = windowSize
+	}
+}
+
+// onLoss shrinks the window when segments are found lost,
+// sentEnd being the segment after the last one sent.
+func (c *congestion) onLoss(sentEnd uint32) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.recovering {
+		return
+	}
+	c.ssthresh = c.cwnd * lossBackoff
+	if c.ssthresh < minSsthresh {
+		c.ssthresh = minSsthresh
+	}
+	c.cwnd = c.ssthresh
+	c.recovering = true
+	c.recoverSeq = sentEnd
+}
+
+// onTimeout brings the window down to one segment, at most once per
+// timeout period, so that a burst of segments lost together counts
+// as a single loss.
+func (c *congestion) onTimeout(rto time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastTimeout) < rto {
+		return
+	}
+	c.lastTimeout = now
+	c.ssthresh = c.cwnd * lossBackoff
+	if c.ssthresh < minSsthresh {
+		c.ssthresh = minSsthresh
+	}
+	c.cwnd = 1
+	c.recovering = false
+}
+
+// onSend spaces the next data segment so that a window is sent
+// over half the round trip time in slow start, and over most of it after,
+// leaving room for the window to grow. No pacing is done before
+// the round trip time is known.
+func (c *congestion) onSend(now time.Time, srtt time.Duration) {
+	if srtt == 0 {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.nextSend.Before(now) {
+		c.nextSend = now
+	}
+	rate := c.cwnd * 1.25
+	if c.cwnd < c.ssthresh {
+		rate = c.cwnd * 2
+	}
+	c.interval = time.Duration(float64(srtt) / rate)
+	c.nextSend = c.nextSend.Add(c.interval)
+}
+
+// paced returns how long the next data segment must wait, or zero.
+func (c *congestion) paced(now time.Time) time.Duration {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ahead := paceBurst * c.interval
+	if now.Add(ahead).Before(c.nextSend) {
+		return c.nextSend.Sub(now) - ahead
+	}
+	return 0
+}
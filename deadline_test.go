@@ -0,0 +1,64 @@
+package icmpnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadlineSet(t *testing.T) {
+	const wait = 50 * time.Millisecond
+	past := func() time.Time { return time.Now().Add(-time.Second) }
+	future := func() time.Time { return time.Now().Add(wait) }
+	zero := func() time.Time { return time.Time{} }
+	far := func() time.Time { return time.Now().Add(time.Hour) }
+
+	tests := []struct {
+		name   string
+		sets   []func() time.Time
+		closed bool // right away
+		later  bool // after wait
+	}{
+		{"never set", nil, false, false},
+		{"past", []func() time.Time{past}, true, true},
+		{"future", []func() time.Time{future}, false, true},
+		{"far", []func() time.Time{far}, false, false},
+		{"zero disarms past", []func() time.Time{past, zero}, false, false},
+		{"zero disarms future", []func() time.Time{future, zero}, false, false},
+		{"past then future", []func() time.Time{past, future}, false, true},
+		{"future then far", []func() time.Time{future, far}, false, false},
+		{"far then past", []func() time.Time{far, past}, true, true},
+		{"past twice", []func() time.Time{past, past}, true, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			d := newDeadline()
+			for _, at := range tt.sets {
+				d.set(at())
+			}
+			if got := isClosedChan(d.wait()); got != tt.closed {
+				t.Fatalf("closed right away = %v, want %v", got, tt.closed)
+			}
+			time.Sleep(2 * wait)
+			if got := isClosedChan(d.wait()); got != tt.later {
+				t.Fatalf("closed after %v = %v, want %v", 2*wait, got, tt.later)
+			}
+		})
+	}
+}
+
+func TestDeadlineSetAfterFired(t *testing.T) {
+	d := newDeadline()
+	d.set(time.Now().Add(time.Millisecond))
+	<-d.wait()
+	// the timer fired, set must not wait on it nor reuse its channel
+	d.set(time.Now().Add(time.Hour))
+	if isClosedChan(d.wait()) {
+		t.Fatal("deadline still closed after it was moved")
+	}
+	d.set(time.Time{})
+	if isClosedChan(d.wait()) {
+		t.Fatal("deadline closed after it was disarmed")
+	}
+}
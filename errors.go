@@ -0,0 +1,43 @@
+package icmpnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// errors a connection fails with, a Dialer wraps them in a *DialError
+var (
+	ErrUnreachable     = fmt.Errorf("server unreachable")
+	ErrNoReply         = fmt.Errorf("no reply from server")
+	ErrWrongKey        = fmt.Errorf("wrong key")
+	ErrVersionMismatch = fmt.Errorf("protocol version mismatch")
+	ErrReset           = fmt.Errorf("connection reset by server")
+	ErrServerBusy      = fmt.Errorf("server busy")
+	ErrTooManySessions = fmt.Errorf("too many sessions from this address")
+)
+
+// DialError is returned by a Dialer that fails to connect.
+// Err is one of the errors above, a context error or a socket error.
+type DialError struct {
+	Addr string
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("icmpnet: dial %s: %v", e.Addr, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the server did not answer in time.
+func (e *DialError) Timeout() bool {
+	return errors.Is(e.Err, context.DeadlineExceeded) || errors.Is(e.Err, ErrNoReply)
+}
+
+// Temporary implements net.Error
+func (e *DialError) Temporary() bool {
+	return e.Timeout()
+}
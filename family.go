@@ -0,0 +1,96 @@
+package icmpnet
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// icmpFamily holds the protocol details of ICMP for one address family.
+type icmpFamily struct {
+	network      string
+	dgramNetwork string
+	address      string
+	protocol     int
+	echoRequest  icmp.Type
+	echoReply    icmp.Type
+	unreachable  icmp.Type
+	ipHeaderSize int // of the datagram quoted in an error message
+}
+
+var (
+	familyV4 = &icmpFamily{
+		network:      "ip4:icmp",
+		dgramNetwork: "udp4",
+		address:      "0.0.0.0",
+		protocol:     1,
+		echoRequest:  ipv4.ICMPTypeEcho,
+		echoReply:    ipv4.ICMPTypeEchoReply,
+		unreachable:  ipv4.ICMPTypeDestinationUnreachable,
+		ipHeaderSize: ipv4.HeaderLen,
+	}
+	familyV6 = &icmpFamily{
+		network:      "ip6:ipv6-icmp",
+		dgramNetwork: "udp6",
+		address:      "::",
+		protocol:     58,
+		echoRequest:  ipv6.ICMPTypeEchoRequest,
+		echoReply:    ipv6.ICMPTypeEchoReply,
+		unreachable:  ipv6.ICMPTypeDestinationUnreachable,
+		ipHeaderSize: ipv6.HeaderLen,
+	}
+)
+
+// families are the address families served by a listener.
+var families = []*icmpFamily{familyV4, familyV6}
+
+func familyOf(addr net.Addr) *icmpFamily {
+	if ip := addrIP(addr); ip != nil && ip.To4() == nil {
+		return familyV6
+	}
+	return familyV4
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// unreachableEcho returns the destination and the echo id of the request
+// quoted in a destination unreachable message, if it quotes an echo request.
+func (f *icmpFamily) unreachableEcho(msg *icmp.Message) (net.IP, int, bool) {
+	body, ok := msg.Body.(*icmp.DstUnreach)
+	if !ok || len(body.Data) < f.ipHeaderSize {
+		return nil, 0, false
+	}
+	b := body.Data
+	var dst net.IP
+	if f == familyV4 {
+		dst = net.IP(b[16:20])
+		hl := int(b[0]&0x0f) << 2
+		if hl < ipv4.HeaderLen || hl > len(b) {
+			return nil, 0, false
+		}
+		b = b[hl:]
+	} else {
+		dst = net.IP(b[24:40])
+		b = b[ipv6.HeaderLen:]
+	}
+	if len(b) < 8 {
+		return nil, 0, false
+	}
+	// type, code, checksum, id, seq
+	req, err := icmp.ParseMessage(f.protocol, b[:8])
+	if err != nil || req.Type != f.echoRequest {
+		return nil, 0, false
+	}
+	return dst, int(binary.BigEndian.Uint16(b[4:6])), true
+}
@@ -2,162 +2,715 @@ package icmpnet
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 )
 
+const (
+	holdTimeout = time.Second
+	idleTimeout = 5 * time.Second
+)
+
+// lingerTimeout is the longest Close waits for the peer,
+// a variable for the tests.
+var lingerTimeout = time.Minute
+
+var errLinger = fmt.Errorf("gave up waiting for the peer to close")
+
+// PollCount is the number of empty echo requests a client keeps parked
+// at the server, so that the server can push data as soon as it is written.
+// It is the default of DialConfig.PollCount.
+var PollCount = 4
+
 type host interface {
 	sendMsg(msg *icmp.Message, addr net.Addr) error
 	onConnClose(conn *icmpConn)
-	localAddr() net.Addr
+	localAddr(f *icmpFamily) net.Addr
 }
 
 type icmpConn struct {
 	bufferConn
+	family *icmpFamily
 	id     uint16
 	readCh chan *icmp.Message
 	host   host
+	cfg    *connConfig
+
+	limiter *tokenBucket // packet rate of the client, used by the server's main loop
+
+	snd         *sendWindow
+	rcv         *recvWindow
+	rtt         *rttEstimator
+	cc          *congestion
+	polls       int
+	payloadSize int
+	echoSeq     uint16
+	advertised  uint16 // window sent in the last packet
+
+	session     uint32
+	clientNonce []byte
+	serverNonce []byte
+	aesKey      []byte // checked by the server in the handshake
+	ticket      []byte // proves moves, see migrate.go
+	options     uint8  // granted by the server in the handshake
+	openCh      chan struct{}
+	parked      int32 // the client is gone quiet, accessed atomically
+
+	migrations    uint32    // moves of the session, used by the server's main loop
+	lastChallenge []byte    // last challenge answered by the client
+	challengedAt  time.Time // when it was answered
+
+	closeAt        time.Time // when writing was closed, or the peer last acknowledged data since
+	finQueued      bool      // our FIN is in the send window
+	peerReadClosed bool      // the peer no longer reads, so we stopped writing
+	doneCh         chan struct{}
+
+	err      error // why the connection failed, set before failCh is closed
+	failCh   chan struct{}
+	failOnce sync.Once
+
+	stats    Stats
+	lastRecv time.Time
+	statsMtx sync.Mutex
 }
 
-func newICMPConn(h host, id int, addr net.Addr) *icmpConn {
+func newICMPConn(h host, id int, addr net.Addr, cfg *connConfig) *icmpConn {
+	family := familyOf(addr)
 	ic := &icmpConn{
-		bufferConn: *newBufferConn(h.localAddr(), addr),
+		bufferConn: *newBufferConn(h.localAddr(family), addr, cfg),
+		family:     family,
 		id:         uint16(id),
-		readCh:     make(chan *icmp.Message, 100),
+		readCh:     make(chan *icmp.Message, cfg.readQueueSize),
 		host:       h,
+		cfg:        cfg,
+		snd:        newSendWindow(windowSize),
+		rcv:        newRecvWindow(windowSize),
+		rtt:        newRTTEstimator(),
+		cc:         newCongestion(),
+
+		polls:       cfg.pollCount,
+		payloadSize: cfg.payloadSize,
+		advertised:  windowSize,
+		openCh:      make(chan struct{}),
+		doneCh:      make(chan struct{}),
+		failCh:      make(chan struct{}),
 	}
+	ic.stats.PayloadSize = ic.payloadSize
 	return ic
 }
 
-func newICMPServerConn(h host, id int, addr net.Addr) *icmpConn {
-	ic := newICMPConn(h, id, addr)
+func newICMPServerConn(h host, session uint32, clientNonce, aesKey []byte, addr net.Addr, cfg *connConfig) *icmpConn {
+	ic := newICMPConn(h, 0, addr, cfg)
+	ic.aesKey = aesKey
+	ic.session = session
+	ic.clientNonce = append([]byte(nil), clientNonce...)
+	ic.serverNonce = newNonce()
+	ic.ticket = sessionTicket(aesKey, ic.clientNonce, ic.serverNonce)
 	go ic.serverLoop()
 	return ic
 }
 
-func newICMPClientConn(h host, id int, addr net.Addr) *icmpConn {
-	ic := newICMPConn(h, id, addr)
-	go ic.clientLoop()
+// newICMPClientConn creates a client connection,
+// its host must be ready to route the handshake reply before clientLoop starts.
+func newICMPClientConn(h host, id int, addr net.Addr, aesKey []byte, cfg *connConfig) *icmpConn {
+	ic := newICMPConn(h, id, addr, cfg)
+	ic.aesKey = aesKey
+	ic.clientNonce = newNonce()
 	return ic
 }
 
+// wrapConn returns ic in the layers of its session, the stream
+// being compressed before it is encrypted.
+func wrapConn(ic *icmpConn, aesKey []byte, cfg *connConfig) (net.Conn, error) {
+	var conn net.Conn = ic
+	if aesKey != nil {
+		sc, err := newSecureConn(conn, aesKey, cfg)
+		if err != nil {
+			return nil, err
+		}
+		conn = sc
+	}
+	if ic.options&optCompress != 0 {
+		conn = newCompressConn(conn, cfg)
+	}
+	return conn, nil
+}
+
+// serverLoop answers each echo request with at most one data segment.
+// Requests that carry nothing are held until there is data to send
+// or holdTimeout passes, so that data written by the application
+// can be pushed to the client without waiting for its next request.
+// A session without requests for the idle timeout is parked
+// for the resume timeout, in case the client comes back.
 func (ic *icmpConn) serverLoop() {
-	defer func() {
-		ic.Close()
-		ic.host.onConnClose(ic)
-	}()
+	defer ic.finish()
 
 	var (
-		n    int
-		body *icmp.Echo
-		ok   bool
+		held []*heldRequest
 		err  error
 	)
 
-	prevSeq := 0
-	buf := make([]byte, 4096)
+	lastRequest := time.Now()
+	closing := ic.wclosedCh
+	readClosing := ic.rclosedCh
+	buf := make([]byte, maxPacketSize)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
 
 	for {
+		if ic.closed() {
+			return
+		}
+		if quiet := time.Since(lastRequest); quiet > ic.idleTimeout() {
+			if quiet > ic.quietTimeout() {
+				ic.cfg.log("%v: no request for %v", ic, quiet.Round(time.Second))
+				return
+			}
+			if atomic.CompareAndSwapInt32(&ic.parked, 0, 1) {
+				ic.cfg.log("%v: no request for %v, parked", ic, ic.idleTimeout())
+			}
+		}
+		held, err = ic.answerHeld(held, buf)
+		if err != nil {
+			return
+		}
+
+		var holdC <-chan time.Time
+		if len(held) > 0 {
+			holdC = time.After(time.Until(held[0].at.Add(holdTimeout)))
+		}
+
 		select {
 		case msg := <-ic.readCh:
-			isNewMsg := false
-			body, ok = msg.Body.(*icmp.Echo)
-			if ok {
-				if body.Seq == prevSeq+1 || body.Seq == 1 {
-					isNewMsg = true
-					prevSeq = body.Seq
-					ic.writeInBuf(body.Data)
-				}
+			body, ok := ic.received(msg)
+			if !ok {
+				continue
 			}
-
-			if isNewMsg {
-				n, err = ic.readOutBuf(buf)
-				if err != nil {
+			p, err := parsePacket(body.Data, magicRequest)
+			if err != nil {
+				continue
+			}
+			lastRequest = time.Now()
+			if atomic.CompareAndSwapInt32(&ic.parked, 1, 0) {
+				ic.cfg.log("%v: resumed", ic)
+			}
+			if p.typ == typeProbe {
+				if err := ic.answerProbe(msg, p); err != nil {
 					return
 				}
+				continue
 			}
+			ic.handlePacket(p)
 
-			if n == 0 && len(body.Data) == 0 {
-				time.Sleep(300 * time.Millisecond)
+			if err := ic.fillSendWindow(buf); err != nil {
+				return
+			}
+			if p.typ != typeData && ic.due(time.Now()) == nil {
+				held = append(held, &heldRequest{msg: msg, at: time.Now()})
+				if len(held) <= windowSize {
+					continue
+				}
+				msg, held = held[0].msg, held[1:]
+			}
+			if err := ic.sendReply(msg); err != nil {
+				return
 			}
 
-			body.Data = buf[:n]
-			msg.Type = ipv4.ICMPTypeEchoReply
-			err = ic.host.sendMsg(msg, ic.remoteAddr)
-			if err != nil {
+		case <-holdC:
+			if err := ic.sendReply(held[0].msg); err != nil {
 				return
 			}
+			held = held[1:]
+
+		case <-closing:
+			closing = nil
+			ic.queueFin()
+
+		case <-readClosing:
+			// tell the client to stop writing
+			readClosing = nil
+			if len(held) > 0 {
+				if err := ic.sendReply(held[0].msg); err != nil {
+					return
+				}
+				held = held[1:]
+			}
+
+		case <-ic.inSpaceCh:
+			if ic.windowOpened() && len(held) > 0 {
+				if err := ic.sendReply(held[0].msg); err != nil {
+					return
+				}
+				held = held[1:]
+			}
+
+		case <-ic.outCh:
+		case <-ic.paceC():
+		case <-ticker.C:
 
-		case <-time.After(5 * time.Second):
-			// fmt.Println("packet may lost")
+		case <-ic.failCh:
 			return
 		}
 	}
 }
 
+type heldRequest struct {
+	msg *icmp.Message
+	at  time.Time
+}
+
+// answerHeld replies to the parked requests, oldest first,
+// as long as there are segments to send.
+func (ic *icmpConn) answerHeld(held []*heldRequest, buf []byte) ([]*heldRequest, error) {
+	for len(held) > 0 {
+		if err := ic.fillSendWindow(buf); err != nil {
+			return held, err
+		}
+		if ic.due(time.Now()) == nil {
+			break
+		}
+		if err := ic.sendReply(held[0].msg); err != nil {
+			return held, err
+		}
+		held = held[1:]
+	}
+	return held, nil
+}
+
+// clientLoop keeps up to windowSize echo requests outstanding,
+// each carrying a data segment or polling the server for its data.
+// At least ic.polls requests are kept outstanding at all times.
 func (ic *icmpConn) clientLoop() {
-	defer func() {
-		ic.Close()
-		ic.host.onConnClose(ic)
-	}()
+	defer ic.finish()
+
+	if err := ic.handshake(); err != nil {
+		ic.fail(err)
+		return
+	}
+	if err := ic.probePayloadSize(); err != nil {
+		ic.fail(err)
+		return
+	}
+	ic.cfg.log("%v: open, payload size %d", ic, ic.payloadSize)
+	close(ic.openCh)
 
 	var (
-		n   int
-		err error
+		peerMore bool
+		needAck  bool
+		resuming bool
 	)
 
-	seq := 1
-	prevSeq := 0
-	buf := make([]byte, 4096)
+	pending := make(map[uint16]time.Time) // outstanding requests by echo seq
+	lastReply := time.Now()
+	closing := ic.wclosedCh
+	readClosing := ic.rclosedCh
+	buf := make([]byte, maxPacketSize)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
 
 	for {
-		if seq == prevSeq+1 {
-			prevSeq = seq
-			n, err = ic.readOutBuf(buf)
-			if err != nil {
+		if ic.closed() {
+			return
+		}
+		now := time.Now()
+		if quiet := now.Sub(lastReply); quiet > ic.idleTimeout() {
+			if quiet > ic.quietTimeout() {
+				ic.cfg.log("%v: no reply for %v", ic, quiet.Round(time.Second))
+				ic.fail(ErrNoReply)
 				return
 			}
+			if !resuming {
+				ic.cfg.log("%v: no reply for %v, trying to resume", ic, ic.idleTimeout())
+				resuming = true
+				ic.cfg.state(StateResuming)
+			}
 		}
-		body := &icmp.Echo{
-			ID:   int(ic.id),
-			Seq:  seq,
-			Data: buf[:n],
+		expiry := holdTimeout + ic.rtt.rto()
+		if resuming && expiry > 2*holdTimeout {
+			// keep polling while the timeout backs off,
+			// so that the session resumes soon after the network is back
+			expiry = 2 * holdTimeout
 		}
-		msg := &icmp.Message{
-			Type: ipv4.ICMPTypeEcho,
-			Code: 0,
-			Body: body,
+		for seq, sentAt := range pending {
+			// polls may be held by the server before it replies
+			if now.Sub(sentAt) >= expiry {
+				delete(pending, seq)
+				ic.rtt.onTimeout()
+			}
 		}
-		err = ic.host.sendMsg(msg, ic.remoteAddr)
-		if err != nil {
+		if err := ic.fillSendWindow(buf); err != nil {
 			return
 		}
+		for len(pending) < windowSize {
+			seg := ic.due(time.Now())
+			if seg == nil && len(pending) >= ic.polls && !peerMore && !needAck {
+				break
+			}
+			seq, err := ic.sendRequest(ic.newPacket(seg))
+			if err != nil {
+				if ic.cfg.resumeTimeout > 0 {
+					// the network may be down for a while,
+					// the segment is sent again once it is back
+					break
+				}
+				ic.fail(err)
+				return
+			}
+			pending[seq] = now
+			needAck = false
+		}
 
 		select {
 		case msg := <-ic.readCh:
-			if body, ok := msg.Body.(*icmp.Echo); ok {
-				if seq == body.Seq {
-					ic.writeInBuf(body.Data)
-					seq++
+			body, ok := ic.received(msg)
+			if !ok {
+				continue
+			}
+			delete(pending, uint16(body.Seq))
+			p, err := parsePacket(body.Data, magicReply)
+			if err != nil || p.session != ic.session {
+				continue
+			}
+			lastReply = time.Now()
+			if resuming {
+				ic.cfg.log("%v: resumed", ic)
+				resuming = false
+				ic.cfg.state(StateConnected)
+			}
+			if p.typ == typeMigrate {
+				if mp := ic.migratePacket(p.data); mp != nil {
+					if seq, err := ic.sendRequest(mp); err == nil {
+						pending[seq] = time.Now()
+					}
 				}
+				continue
+			}
+			peerMore = p.hasFlag(flagMore)
+			needAck = p.typ == typeData
+			ic.handlePacket(p)
+			if ic.closed() {
+				// acknowledge the server's FIN before leaving
+				ic.sendRequest(ic.newPacket(nil))
+				return
+			}
+
+		case <-closing:
+			closing = nil
+			ic.queueFin()
+
+		case <-readClosing:
+			// tell the server to stop writing
+			readClosing = nil
+			needAck = true
+
+		case <-ic.inSpaceCh:
+			if ic.windowOpened() {
+				needAck = true
 			}
-		case <-time.After(2 * time.Second):
-			// fmt.Println("not received reply")
+
+		case <-ic.outCh:
+		case <-ic.paceC():
+		case <-ticker.C:
+
+		case <-ic.failCh:
+			return
+		}
+	}
+}
+
+// fillSendWindow moves data written by the application into new segments.
+func (ic *icmpConn) fillSendWindow(buf []byte) error {
+	buf = buf[:ic.payloadSize-headerSize]
+	for !ic.snd.full() {
+		n, err := ic.readOutBuf(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		ic.snd.push(buf[:n])
+	}
+	ic.queueFin()
+	return nil
+}
+
+// queueFin ends the stream once writing is closed and all data is queued.
+func (ic *icmpConn) queueFin() {
+	if ic.finQueued {
+		return
+	}
+	select {
+	case <-ic.wclosedCh:
+		if ic.closeAt.IsZero() {
+			ic.closeAt = time.Now()
+		}
+		if ic.outBufLen() == 0 {
+			ic.finQueued = ic.snd.pushFin()
+		}
+	default:
+	}
+}
+
+// closed reports whether the stream is over both ways, the FIN of the peer
+// received and ours acknowledged. Once writing is closed, the data left
+// and our FIN are given up on when the peer acknowledges nothing
+// for a while, as when its window stays closed, and so is the FIN
+// of the peer once we no longer read.
+func (ic *icmpConn) closed() bool {
+	if ic.closeAt.IsZero() {
+		return false
+	}
+	flushed := ic.finQueued && ic.snd.empty()
+	if time.Since(ic.closeAt) > ic.idleTimeout() && (!flushed || ic.readClosed()) {
+		return true
+	}
+	return flushed && ic.rcv.fin
+}
+
+// finish is called when the loop of the connection exits.
+func (ic *icmpConn) finish() {
+	select {
+	case <-ic.failCh:
+		ic.cfg.log("%v: closed: %v", ic, ic.err)
+	default:
+		ic.cfg.log("%v: closed", ic)
+	}
+	ic.closeWrite()
+	ic.setEOF()
+	close(ic.doneCh)
+	ic.host.onConnClose(ic)
+}
+
+// fail ends the connection with err, without telling the peer.
+// Only the first error is kept.
+func (ic *icmpConn) fail(err error) {
+	ic.failOnce.Do(func() {
+		ic.err = err
+		close(ic.failCh)
+	})
+}
+
+// unreachable fails a connection that is not open yet,
+// once the network reported the server can not be reached.
+func (ic *icmpConn) unreachable() {
+	select {
+	case <-ic.openCh:
+	default:
+		ic.fail(ErrUnreachable)
+	}
+}
+
+// Close closes both ways, see CloseRead and CloseWrite.
+// It returns once the peer acknowledged and closed its side too,
+// or gave no answer for a while, and after lingerTimeout at most.
+func (ic *icmpConn) Close() error {
+	return ic.closeBy(time.Now().Add(lingerTimeout))
+}
+
+// closeBy closes ic, giving up on the peer at deadline.
+func (ic *icmpConn) closeBy(deadline time.Time) error {
+	select {
+	case <-ic.closedCh:
+		return io.ErrClosedPipe
+	default:
+	}
+	ic.closeRead()
+	ic.closeWrite()
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-ic.doneCh:
+	case <-t.C:
+		ic.fail(errLinger)
+		<-ic.doneCh
+	}
+	return ic.bufferConn.Close()
+}
+
+// CloseWrite flushes the data written so far and ends the stream
+// to the peer, which then reads io.EOF. Reading goes on
+// until the peer closes its side.
+func (ic *icmpConn) CloseWrite() error {
+	select {
+	case <-ic.closedCh:
+		return io.ErrClosedPipe
+	default:
+	}
+	ic.closeWrite()
+	return nil
+}
+
+// CloseRead drops the data not read yet and the data received later,
+// and tells the peer to stop writing.
+func (ic *icmpConn) CloseRead() error {
+	select {
+	case <-ic.closedCh:
+		return io.ErrClosedPipe
+	default:
+	}
+	ic.closeRead()
+	return nil
+}
+
+func (ic *icmpConn) handlePacket(p *packet) {
+	rtt, acked := ic.snd.ack(p.ack, p.sack)
+	ic.rtt.sample(rtt)
+	ic.cc.onAck(p.ack, acked)
+	if acked > 0 && !ic.closeAt.IsZero() {
+		// the peer still takes data, give it time for the rest
+		ic.closeAt = time.Now()
+	}
+	if ic.snd.markLost(time.Now(), ic.rtt.smoothed()) {
+		ic.cc.onLoss(ic.snd.sentEnd())
+	}
+	ic.snd.peerWindow = int(p.window)
+	if p.hasFlag(flagReadClosed) && !ic.peerReadClosed {
+		// what is left to write would be dropped by the peer
+		ic.peerReadClosed = true
+		ic.closeWrite()
+		ic.discardOutBuf()
+	}
+	if p.typ != typeData {
+		return
+	}
+	ready, ok := ic.rcv.receive(p)
+	if !ok {
+		ic.count(func(stats *Stats) { stats.Duplicates++ })
+	}
+	for _, data := range ready {
+		ic.writeInBuf(data)
+	}
+	if ic.rcv.fin {
+		ic.setEOF()
+	}
+}
+
+// newPacket builds the next packet to the peer, carrying seg if not nil.
+func (ic *icmpConn) newPacket(seg *segment) *packet {
+	p := &packet{typ: typeAck, session: ic.session}
+	p.ack, p.sack = ic.rcv.ackFields()
+	p.window = ic.recvWindow()
+	ic.advertised = p.window
+	if ic.readClosed() {
+		p.flags |= flagReadClosed
+	}
+	now := time.Now()
+	if seg == nil {
+		ic.count(func(stats *Stats) { stats.IdlePolls++ })
+	} else {
+		if seg.lost {
+			ic.count(func(stats *Stats) {
+				stats.Retransmits++
+				stats.FastRetransmits++
+			})
+		} else if seg.sent > 0 {
+			ic.rtt.onTimeout()
+			ic.cc.onTimeout(ic.rtt.rto())
+			ic.count(func(stats *Stats) { stats.Retransmits++ })
+		}
+		p.typ = typeData
+		if seg.fin {
+			p.flags |= flagFin
 		}
+		p.seq = seg.seq
+		p.data = seg.data
+		ic.snd.sent(seg, now)
+		ic.cc.onSend(now, ic.rtt.smoothed())
+	}
+	if ic.snd.due(now, ic.rtt.rto(), ic.cc.window()) != nil || ic.outBufLen() > 0 {
+		p.flags |= flagMore
+	}
+	return p
+}
+
+// sendRequest sends p in a new echo request and returns its echo seq.
+// The echo seq wraps around every 65536 requests, which is fine
+// as it only tells apart the requests outstanding at the same time.
+func (ic *icmpConn) sendRequest(p *packet) (uint16, error) {
+	ic.echoSeq++
+	p.session = ic.session
+	msg := &icmp.Message{
+		Type: ic.family.echoRequest,
+		Code: 0,
+		Body: &icmp.Echo{
+			ID:   int(ic.id),
+			Seq:  int(ic.echoSeq),
+			Data: p.marshal(magicRequest),
+		},
 	}
+	return ic.echoSeq, ic.sendMsg(msg)
+}
+
+func (ic *icmpConn) sendReply(msg *icmp.Message) error {
+	seg := ic.due(time.Now())
+	msg.Type = ic.family.echoReply
+	msg.Body.(*icmp.Echo).Data = ic.newPacket(seg).marshal(magicReply)
+	return ic.sendMsg(msg)
+}
+
+// due returns the segment to send now if any,
+// within the congestion window and once pacing allows.
+func (ic *icmpConn) due(now time.Time) *segment {
+	if ic.cc.paced(now) > 0 {
+		return nil
+	}
+	return ic.snd.due(now, ic.rtt.rto(), ic.cc.window())
+}
+
+// paceC fires when pacing allows the segment held back by it to be sent,
+// it is nil if there is none.
+func (ic *icmpConn) paceC() <-chan time.Time {
+	now := time.Now()
+	d := ic.cc.paced(now)
+	if d == 0 || ic.snd.due(now, ic.rtt.rto(), ic.cc.window()) == nil {
+		return nil
+	}
+	return time.After(d)
+}
+
+// recvWindow returns the number of segments the peer may send
+// from the next one expected, as many as inBuf has room for.
+func (ic *icmpConn) recvWindow() uint16 {
+	n := ic.inBufFree() / (ic.payloadSize - headerSize)
+	if n > windowSize {
+		n = windowSize
+	}
+	return uint16(n)
+}
+
+// windowOpened reports whether the application read enough
+// to reopen the window last advertised as closed.
+// The peer must then be told before it can send again.
+func (ic *icmpConn) windowOpened() bool {
+	return ic.advertised == 0 && ic.recvWindow() > 0
+}
+
+// idleTimeout returns how long to wait for the next packet of the peer
+// before considering it gone. It is raised on slow paths but not
+// by the backoff of the timeouts, which grows while the peer is gone.
+func (ic *icmpConn) idleTimeout() time.Duration {
+	if d := 4 * ic.rtt.baseRTO(); d > ic.cfg.idleTimeout {
+		return d
+	}
+	return ic.cfg.idleTimeout
+}
+
+// quietTimeout returns how long the peer may stay quiet
+// before the connection fails, resuming included.
+func (ic *icmpConn) quietTimeout() time.Duration {
+	return ic.idleTimeout() + ic.cfg.resumeTimeout
 }
 
 func (ic *icmpConn) String() string {
-	return icmpConnKey(ic.remoteAddr, ic.ID())
+	return fmt.Sprintf("%s-%d", ic.RemoteAddr(), ic.session)
 }
 
 func (ic *icmpConn) ID() int {
 	return int(ic.id)
 }
-
-func icmpConnKey(remoteAddr net.Addr, id int) string {
-	return fmt.Sprintf("%s-%d", remoteAddr.String(), id)
-}
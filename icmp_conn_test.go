@@ -0,0 +1,152 @@
+package icmpnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloseFin(t *testing.T) {
+	for _, serverCloses := range []bool{false, true} {
+		_, cconn, sconn := memPair(t, &ListenConfig{}, &DialConfig{})
+		from, to := cconn, sconn
+		if serverCloses {
+			from, to = sconn, cconn
+		}
+		data := make([]byte, 300000)
+		rand.Read(data)
+		go func() {
+			from.Write(data)
+			from.Close()
+		}()
+		// the data written before Close is delivered, then io.EOF
+		if got := readAllTimeout(t, to, 10*time.Second); !bytes.Equal(got, data) {
+			t.Fatalf("serverCloses=%v: read %d bytes, want %d", serverCloses, len(got), len(data))
+		}
+		if _, err := to.Write([]byte("x")); err == nil {
+			t.Fatalf("serverCloses=%v: write to a closed peer", serverCloses)
+		}
+		start := time.Now()
+		to.Close()
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("serverCloses=%v: Close took %v once the peer closed", serverCloses, d)
+		}
+	}
+}
+
+func TestPeerWindowReopens(t *testing.T) {
+	// the server reads nothing for a while, closing its window
+	_, cconn, sconn := memPair(t, &ListenConfig{RecvBufferSize: 1}, &DialConfig{})
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := cconn.Write(data)
+		cconn.(halfCloser).CloseWrite()
+		errc <- err
+	}()
+	time.Sleep(time.Second)
+	select {
+	case <-errc:
+		t.Fatal("the whole stream was taken by a peer not reading")
+	default:
+	}
+	if got := readAllTimeout(t, sconn, 30*time.Second); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, want the %d written", len(got), len(data))
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func TestIdleTimeoutPeerGone(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration // each way
+	}{
+		{"fast path", 0},
+		{"slow path", 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newMemNet()
+			n.delay = tt.delay
+			s := memListen(t, n, &ListenConfig{IdleTimeout: time.Second})
+			cconn, err := memDial(n, memClientIP, &DialConfig{IdleTimeout: time.Second})
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			sconn, _ := s.Accept()
+			defer closeAll(cconn, sconn)
+			// a round trip of data for the client to measure the path
+			sconn.Write([]byte("x"))
+			cconn.Read(make([]byte, 1))
+			idle := cconn.(*icmpConn).idleTimeout()
+
+			n.setDown(true)
+			start := time.Now()
+			cconn.SetReadDeadline(start.Add(time.Minute))
+			_, err = cconn.Read(make([]byte, 1))
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("the client did not notice the server was gone")
+			}
+			// the timeouts backing off while the server is gone
+			// do not hold the connection longer
+			if d := time.Since(start); d > 2*idle {
+				t.Fatalf("the client noticed the server was gone after %v, want about %v", d, idle)
+			}
+		})
+	}
+}
+
+func TestOutage(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	tests := []struct {
+		name   string
+		key    []byte
+		delay  time.Duration // each way
+		resume time.Duration
+		outage time.Duration
+	}{
+		{"resumed", nil, 0, 10 * time.Second, 3 * time.Second},
+		{"resumed encrypted", key, 0, 10 * time.Second, 3 * time.Second},
+		// longer than the idle timeout configured, shorter than
+		// the one raised on the slow path, which the frames
+		// of the encryption wait as long as the connection
+		{"slow path", nil, 300 * time.Millisecond, 0, 3 * time.Second},
+		{"slow path encrypted", key, 300 * time.Millisecond, 0, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newMemNet()
+			n.delay = tt.delay
+			s := memListen(t, n, &ListenConfig{AESKey: tt.key, IdleTimeout: time.Minute, ResumeTimeout: tt.resume})
+			cconn, err := memDial(n, memClientIP, &DialConfig{AESKey: tt.key, IdleTimeout: time.Second, ResumeTimeout: tt.resume})
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			sconn, _ := s.Accept()
+			defer closeAll(cconn, sconn)
+
+			// written a chunk at a time, for the outage to cut the stream
+			data := make([]byte, 128<<10)
+			rand.Read(data)
+			go func() {
+				for b := data; len(b) > 0; b = b[16<<10:] {
+					sconn.Write(b[:16<<10])
+					time.Sleep(100 * time.Millisecond)
+				}
+				sconn.(halfCloser).CloseWrite()
+			}()
+			time.AfterFunc(time.Second, func() {
+				n.setDown(true)
+				time.AfterFunc(tt.outage, func() { n.setDown(false) })
+			})
+			if got := readAllTimeout(t, cconn, time.Minute); !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes, want the %d written", len(got), len(data))
+			}
+		})
+	}
+}
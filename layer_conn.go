@@ -0,0 +1,150 @@
+package icmpnet
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// halfCloser is a connection that closes one way at a time.
+type halfCloser interface {
+	CloseWrite() error
+	CloseRead() error
+}
+
+// deadlineCloser is a connection whose Close waits for its peer,
+// until a deadline shared by the layers of the connection.
+type deadlineCloser interface {
+	closeBy(deadline time.Time) error
+}
+
+// layerConn is the part shared by the layers wrapped around
+// the icmpConn of a session, see wrapConn. It buffers the stream
+// of its layer and passes the closes of either way down
+// to the base connection.
+type layerConn struct {
+	bufferConn
+	baseConn  net.Conn
+	flushedCh chan struct{}
+}
+
+func newLayerConn(baseConn net.Conn, cfg *connConfig) *layerConn {
+	return &layerConn{
+		bufferConn: *newBufferConn(baseConn.LocalAddr(), baseConn.RemoteAddr(), cfg),
+		baseConn:   baseConn,
+		flushedCh:  make(chan struct{}),
+	}
+}
+
+// deliver hands data decoded from the base connection to Read.
+// It leaves the data not decoded yet in the base connection,
+// which stops its peer, until the application reads.
+// It returns false if the connection is closed meanwhile.
+func (lc *layerConn) deliver(b []byte) bool {
+	if !lc.waitInSpace() {
+		return false
+	}
+	lc.writeInBuf(b)
+	return true
+}
+
+// writeLoop passes the data written to send until writing is closed
+// and everything written is flushed to the base connection,
+// whose writing is then closed too. end, if not nil, is called
+// after the last of the data.
+func (lc *layerConn) writeLoop(send func(b []byte) error, end func() error) {
+	defer func() {
+		lc.closeWrite()
+		if hc, ok := lc.baseConn.(halfCloser); ok {
+			hc.CloseWrite()
+		}
+		close(lc.flushedCh)
+	}()
+
+	buf := make([]byte, 32768)
+	for {
+		n, _ := lc.readOutBuf(buf)
+		if n == 0 {
+			select {
+			case <-lc.outCh:
+			case <-lc.wclosedCh:
+				if lc.outBufLen() == 0 {
+					if end != nil {
+						end()
+					}
+					return
+				}
+			}
+			continue
+		}
+		if err := send(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// Close flushes the data written so far and closes the base connection.
+// It gives up on a peer that takes no data after lingerTimeout.
+func (lc *layerConn) Close() error {
+	return lc.closeBy(time.Now().Add(lingerTimeout))
+}
+
+// closeBy closes lc, giving up on flushing the data at deadline.
+// Closing the base connection then makes its writes fail,
+// which ends writeLoop.
+func (lc *layerConn) closeBy(deadline time.Time) error {
+	select {
+	case <-lc.closedCh:
+		return io.ErrClosedPipe
+	default:
+	}
+	lc.closeWrite()
+	t := time.NewTimer(time.Until(deadline))
+	select {
+	case <-lc.flushedCh:
+	case <-t.C:
+	}
+	t.Stop()
+	var err error
+	if dc, ok := lc.baseConn.(deadlineCloser); ok {
+		err = dc.closeBy(deadline)
+	} else {
+		err = lc.baseConn.Close()
+	}
+	<-lc.flushedCh
+	lc.bufferConn.Close()
+	return err
+}
+
+// CloseWrite flushes the data written so far and closes writing
+// on the base connection.
+func (lc *layerConn) CloseWrite() error {
+	select {
+	case <-lc.closedCh:
+		return io.ErrClosedPipe
+	default:
+	}
+	lc.closeWrite()
+	return nil
+}
+
+// CloseRead drops the data not read yet and closes reading
+// on the base connection.
+func (lc *layerConn) CloseRead() error {
+	select {
+	case <-lc.closedCh:
+		return io.ErrClosedPipe
+	default:
+	}
+	lc.closeRead()
+	if hc, ok := lc.baseConn.(halfCloser); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
+
+// RemoteAddr returns the address of the base connection,
+// which changes when the client moves.
+func (lc *layerConn) RemoteAddr() net.Addr {
+	return lc.baseConn.RemoteAddr()
+}
@@ -0,0 +1,121 @@
+package icmpnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloseStalledPeer(t *testing.T) {
+	defer func(d time.Duration) { lingerTimeout = d }(lingerTimeout)
+	lingerTimeout = time.Second
+
+	key := bytes.Repeat([]byte{1}, 16)
+	tests := []struct {
+		name string
+		lc   ListenConfig
+		dc   DialConfig
+	}{
+		{"plain", ListenConfig{}, DialConfig{}},
+		{"encrypted", ListenConfig{AESKey: key}, DialConfig{AESKey: key}},
+		{"compressed", ListenConfig{Compress: true}, DialConfig{Compress: true}},
+		{"encrypted and compressed", ListenConfig{AESKey: key, Compress: true},
+			DialConfig{AESKey: key, Compress: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the server never reads, until its window is closed
+			tt.lc.RecvBufferSize = 1
+			tt.dc.SendBufferSize = 1 << 10
+			_, cconn, _ := memPair(t, &tt.lc, &tt.dc)
+
+			data := make([]byte, 1<<20)
+			rand.Read(data)
+			cconn.SetWriteDeadline(time.Now().Add(time.Second))
+			if n, err := cconn.Write(data); err == nil {
+				t.Fatalf("wrote %d bytes to a peer not reading", n)
+			}
+
+			start := time.Now()
+			done := make(chan struct{})
+			go func() {
+				cconn.Close()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(lingerTimeout + idleTimeout):
+				t.Fatal("Close stalled on a peer not reading")
+			}
+			if d := time.Since(start); d < lingerTimeout/2 {
+				t.Fatalf("Close returned after %v, before giving the peer time", d)
+			}
+		})
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	tests := []struct {
+		name string
+		lc   ListenConfig
+		dc   DialConfig
+	}{
+		{"plain", ListenConfig{}, DialConfig{}},
+		{"encrypted", ListenConfig{AESKey: key}, DialConfig{AESKey: key}},
+		{"compressed", ListenConfig{Compress: true}, DialConfig{Compress: true}},
+		{"encrypted and compressed", ListenConfig{AESKey: key, Compress: true},
+			DialConfig{AESKey: key, Compress: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, cconn, sconn := memPair(t, &tt.lc, &tt.dc)
+
+			// a request ended by CloseWrite, answered on the other way
+			if _, err := cconn.Write([]byte("request")); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if err := cconn.(halfCloser).CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite: %v", err)
+			}
+			if _, err := cconn.Write([]byte("x")); err == nil {
+				t.Fatal("write after CloseWrite")
+			}
+			if got := readAllTimeout(t, sconn, 5*time.Second); string(got) != "request" {
+				t.Fatalf("server read %q, want request", got)
+			}
+			if _, err := sconn.Write([]byte("response")); err != nil {
+				t.Fatalf("write after the peer's CloseWrite: %v", err)
+			}
+			sconn.(halfCloser).CloseWrite()
+			if got := readAllTimeout(t, cconn, 5*time.Second); string(got) != "response" {
+				t.Fatalf("client read %q, want response", got)
+			}
+		})
+	}
+}
+
+func TestCloseRead(t *testing.T) {
+	_, cconn, sconn := memPair(t, &ListenConfig{}, &DialConfig{})
+	if err := cconn.(halfCloser).CloseRead(); err != nil {
+		t.Fatalf("CloseRead: %v", err)
+	}
+	// the server is told to stop writing
+	sconn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	var err error
+	for err == nil {
+		_, err = sconn.Write([]byte("dropped"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("writes to a peer that closed reading go on")
+	}
+	// the other way is still open
+	cconn.Write([]byte("hello"))
+	cconn.(halfCloser).CloseWrite()
+	if got := readAllTimeout(t, sconn, 5*time.Second); string(got) != "hello" {
+		t.Fatalf("server read %q, want hello", got)
+	}
+}
@@ -0,0 +1,205 @@
+package icmpnet
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memNet carries ICMP messages in memory between the sockets
+// of a test, so that clients and listeners run their loops
+// as they would over the network, without needing root.
+type memNet struct {
+	mtx     sync.Mutex
+	socks   map[string][]*memSocket  // by address, each reads every message
+	clients map[string]*clientSocket // by address, guarded by socketsMtx
+	down    bool                     // messages are dropped, as on a network gone down
+	delay   time.Duration            // taken by each message
+}
+
+func newMemNet() *memNet {
+	return &memNet{
+		socks:   make(map[string][]*memSocket),
+		clients: make(map[string]*clientSocket),
+	}
+}
+
+// socket returns a new socket reading the messages sent to ip.
+func (n *memNet) socket(ip string) *memSocket {
+	sock := &memSocket{
+		net:      n,
+		addr:     &net.IPAddr{IP: net.ParseIP(ip)},
+		inCh:     make(chan memMsg, 1000),
+		closedCh: make(chan struct{}),
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.socks[ip] = append(n.socks[ip], sock)
+	return sock
+}
+
+func (n *memNet) remove(sock *memSocket) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	ip := sock.addr.IP.String()
+	for i, s := range n.socks[ip] {
+		if s == sock {
+			n.socks[ip] = append(n.socks[ip][:i:i], n.socks[ip][i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *memNet) setDown(down bool) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.down = down
+}
+
+func (n *memNet) route(b []byte, from, to net.Addr) {
+	n.mtx.Lock()
+	socks := n.socks[addrIP(to).String()]
+	down, delay := n.down, n.delay
+	n.mtx.Unlock()
+	if down {
+		return
+	}
+	m := memMsg{append([]byte(nil), b...), from}
+	deliver := func() {
+		for _, sock := range socks {
+			select {
+			case sock.inCh <- m:
+			default:
+				// a full queue drops the message, as the kernel does
+			}
+		}
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, deliver)
+		return
+	}
+	deliver()
+}
+
+type memMsg struct {
+	b    []byte
+	from net.Addr
+}
+
+// memSocket is a net.PacketConn of a memNet.
+type memSocket struct {
+	net       *memNet
+	addr      *net.IPAddr
+	inCh      chan memMsg
+	closedCh  chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *memSocket) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case m := <-s.inCh:
+		return copy(b, m.b), m.from, nil
+	case <-s.closedCh:
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+func (s *memSocket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-s.closedCh:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	s.net.route(b, s.addr, addr)
+	return len(b), nil
+}
+
+func (s *memSocket) Close() error {
+	s.closeOnce.Do(func() {
+		s.net.remove(s)
+		close(s.closedCh)
+	})
+	return nil
+}
+
+func (s *memSocket) LocalAddr() net.Addr                { return s.addr }
+func (s *memSocket) SetDeadline(t time.Time) error      { return nil }
+func (s *memSocket) SetReadDeadline(t time.Time) error  { return nil }
+func (s *memSocket) SetWriteDeadline(t time.Time) error { return nil }
+
+const (
+	memServerIP = "10.0.0.1"
+	memClientIP = "10.0.0.2"
+)
+
+// memListen starts a listener on n at memServerIP,
+// closed at the end of the test.
+func memListen(t *testing.T, n *memNet, lc *ListenConfig) *server {
+	s := lc.newServer(map[*icmpFamily]net.PacketConn{familyV4: n.socket(memServerIP)})
+	s.start()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// memDial dials the listener of n from ip, sharing a socket
+// with the other connections from ip as acquireSocket does.
+func memDial(n *memNet, ip string, dc *DialConfig) (net.Conn, error) {
+	socketsMtx.Lock()
+	sock := n.clients[ip]
+	if sock != nil && sock.refs > 0 {
+		sock.refs++
+	} else {
+		sock = newClientSocket(familyV4, n.socket(ip), false, 1)
+		n.clients[ip] = sock
+		go sock.mainLoop()
+	}
+	socketsMtx.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the socket is closed with the connection, see clientSocket.release
+	return dc.open(ctx, sock, &net.IPAddr{IP: net.ParseIP(memServerIP)}, dc.connConfig())
+}
+
+// memPair opens a session over a new memNet,
+// it returns the client and server ends of the connection.
+func memPair(t *testing.T, lc *ListenConfig, dc *DialConfig) (*memNet, net.Conn, net.Conn) {
+	n := newMemNet()
+	s := memListen(t, n, lc)
+	cconn, err := memDial(n, memClientIP, dc)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	sconn, err := s.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() { closeAll(cconn, sconn) })
+	return n, cconn, sconn
+}
+
+// closeAll closes conns at once, so that none waits for its peer to close.
+func closeAll(conns ...io.Closer) {
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c io.Closer) {
+			defer wg.Done()
+			c.Close()
+		}(c)
+	}
+	wg.Wait()
+}
+
+// readAllTimeout reads conn until io.EOF or an error, giving up after d.
+func readAllTimeout(t *testing.T, conn net.Conn, d time.Duration) []byte {
+	conn.SetReadDeadline(time.Now().Add(d))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v after %d bytes", err, len(b))
+	}
+	return b
+}
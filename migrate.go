@@ -0,0 +1,95 @@
+package icmpnet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// A client keeps its session when its address changes, as when it moves
+// to another network or its NAT mapping changes, or when it comes back
+// after an outage to a session parked by the server. The server answers
+// a packet of the session coming from another address with a MIGRATE
+// carrying a challenge bound to that address. The client answers with
+// a MIGRATE carrying the challenge and a proof computed with the session
+// ticket, and the server then moves the session to the new address.
+// The ticket is derived from both nonces of the handshake and the key,
+// without encryption it only keeps out those who did not see the handshake.
+
+const (
+	challengeSize = 16
+	proofSize     = 16
+)
+
+// challenge returns the challenge for the session to move to addr.
+// It changes with every move, so that an old proof can not be replayed.
+func (ic *icmpConn) challenge(addr net.Addr) []byte {
+	mac := hmac.New(sha256.New, ic.serverNonce)
+	mac.Write([]byte("icmpnet challenge"))
+	binary.Write(mac, binary.BigEndian, ic.session)
+	binary.Write(mac, binary.BigEndian, ic.migrations)
+	mac.Write(addrIP(addr).To16())
+	return mac.Sum(nil)[:challengeSize]
+}
+
+// sessionTicket returns the secret shared by the client and the server
+// of a session once the handshake is over.
+func sessionTicket(aesKey, clientNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, aesKey)
+	mac.Write([]byte("icmpnet ticket"))
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	return mac.Sum(nil)
+}
+
+// proof answers a challenge with the session ticket.
+func (ic *icmpConn) proof(challenge []byte) []byte {
+	mac := hmac.New(sha256.New, ic.ticket)
+	mac.Write(challenge)
+	return mac.Sum(nil)[:proofSize]
+}
+
+// migratePacket returns the packet answering a challenge of the server,
+// or nil if the same challenge was answered less than a timeout ago.
+func (ic *icmpConn) migratePacket(challenge []byte) *packet {
+	if len(challenge) != challengeSize {
+		return nil
+	}
+	if bytes.Equal(challenge, ic.lastChallenge) && time.Since(ic.challengedAt) < ic.rtt.rto() {
+		return nil
+	}
+	ic.lastChallenge = append(ic.lastChallenge[:0], challenge...)
+	ic.challengedAt = time.Now()
+	ic.cfg.log("%v: answering the server's challenge, the address changed", ic)
+	p := ic.newPacket(nil)
+	p.typ = typeMigrate
+	p.data = make([]byte, 0, challengeSize+proofSize)
+	p.data = append(p.data, challenge...)
+	p.data = append(p.data, ic.proof(challenge)...)
+	return p
+}
+
+// migrateSession handles a packet of the session of conn coming
+// from another address than the client's. It reports whether the packet
+// proved that the client moved there, in which case the session is moved,
+// otherwise the client is challenged.
+func (s *server) migrateSession(msg *icmp.Message, conn *icmpConn, p *packet, addr net.Addr) bool {
+	if familyOf(addr) != conn.family {
+		return false
+	}
+	challenge := conn.challenge(addr)
+	if p.typ != typeMigrate || len(p.data) != challengeSize+proofSize ||
+		!hmac.Equal(p.data[:challengeSize], challenge) ||
+		!hmac.Equal(p.data[challengeSize:], conn.proof(challenge)) {
+		s.reply(msg, &packet{typ: typeMigrate, session: conn.session, data: challenge}, addr)
+		return false
+	}
+	s.cfg.log("%v: client moved to %v", conn, addr)
+	s.moveConn(conn, addr)
+	return true
+}
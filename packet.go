@@ -0,0 +1,121 @@
+package icmpnet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// packet header layout, carried at the start of every echo payload
+//
+//	magic (4) | version (1) | type (1) | flags (1) | session (4) |
+//	seq (4) | ack (4) | sack (4) | window (2)
+//
+// magic tells tunnel packets apart from ordinary pings. It differs
+// between requests and replies, so that a client ignores the copy
+// of its request echoed back by a kernel that answers pings.
+// version is protocolVersion. A packet of another version is answered
+// with the packet itself, its magic, version and type changed to
+// a reply of type RST, which is why these three never move.
+// session is the id assigned by the server in the handshake, see session.go.
+// seq numbers the data segment carried by a packet of type data.
+// ack is the next segment expected from the peer and every bit i of sack
+// acknowledges segment ack+1+i received out of order.
+// window is the number of segments from ack on the sender has room for.
+const headerSize = 25
+
+const (
+	magicRequest uint32 = 0x49434e71 // "ICNq"
+	magicReply   uint32 = 0x49434e72 // "ICNr"
+)
+
+// protocolVersion is the version of the packet layout and of the exchanges,
+// peers of different versions reject each other.
+const protocolVersion uint8 = 1
+
+// packet types
+const (
+	typeSyn     uint8 = iota + 1 // client opens a session, server accepts it
+	typeRst                      // server rejects the session
+	typeProbe                    // client probes the payload size, see probe.go
+	typeData                     // packet carries a data segment
+	typeAck                      // packet carries acks only, or polls the server
+	typeMigrate                  // client moves its session to a new address, see migrate.go
+)
+
+// packet flags
+const (
+	flagMore       uint8 = 1 << iota // sender has more data waiting to be sent
+	flagFin                          // data segment ending the stream of the sender
+	flagReadClosed                   // sender no longer reads, the receiver should stop writing
+)
+
+var errOtherVersion = fmt.Errorf("packet of another protocol version")
+
+type packet struct {
+	version uint8
+	typ     uint8
+	flags   uint8
+	session uint32
+	seq     uint32
+	ack     uint32
+	sack    uint32
+	window  uint16
+	data    []byte
+}
+
+func (p *packet) hasFlag(f uint8) bool {
+	return p.flags&f != 0
+}
+
+func (p *packet) marshal(magic uint32) []byte {
+	b := make([]byte, headerSize+len(p.data))
+	binary.BigEndian.PutUint32(b, magic)
+	b[4] = protocolVersion
+	b[5] = p.typ
+	b[6] = p.flags
+	binary.BigEndian.PutUint32(b[7:], p.session)
+	binary.BigEndian.PutUint32(b[11:], p.seq)
+	binary.BigEndian.PutUint32(b[15:], p.ack)
+	binary.BigEndian.PutUint32(b[19:], p.sack)
+	binary.BigEndian.PutUint16(b[23:], p.window)
+	copy(b[headerSize:], p.data)
+	return b
+}
+
+// parsePacket parses the payload of an echo message,
+// which is not a tunnel packet unless it starts with magic.
+// A packet of another version is parsed as if it was of this one,
+// as the rejection of a packet sent by us is, and errOtherVersion returned.
+func parsePacket(b []byte, magic uint32) (*packet, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("short packet")
+	}
+	if binary.BigEndian.Uint32(b) != magic {
+		return nil, fmt.Errorf("not a tunnel packet")
+	}
+	p := &packet{
+		version: b[4],
+		typ:     b[5],
+		flags:   b[6],
+		session: binary.BigEndian.Uint32(b[7:]),
+		seq:     binary.BigEndian.Uint32(b[11:]),
+		ack:     binary.BigEndian.Uint32(b[15:]),
+		sack:    binary.BigEndian.Uint32(b[19:]),
+		window:  binary.BigEndian.Uint16(b[23:]),
+		data:    b[headerSize:],
+	}
+	if p.version != protocolVersion {
+		return p, errOtherVersion
+	}
+	return p, nil
+}
+
+// versionRst turns the payload of a request of another version
+// into its rejection.
+func versionRst(b []byte) []byte {
+	r := append([]byte(nil), b...)
+	binary.BigEndian.PutUint32(r, magicReply)
+	r[4] = protocolVersion
+	r[5] = typeRst
+	return r
+}
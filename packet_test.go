@@ -0,0 +1,93 @@
+package icmpnet
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParsePacket(t *testing.T) {
+	p := &packet{
+		version: protocolVersion,
+		typ:     typeData,
+		flags:   flagMore | flagFin,
+		session: 0x01020304,
+		seq:     0xfffffff0,
+		ack:     7,
+		sack:    1<<0 | 1<<31,
+		window:  windowSize,
+		data:    []byte("data"),
+	}
+	b := p.marshal(magicRequest)
+	other := append([]byte(nil), b...)
+	other[4] = protocolVersion + 1
+
+	tests := []struct {
+		name    string
+		b       []byte
+		magic   uint32
+		want    *packet
+		wantErr error
+	}{
+		{"round trip", b, magicRequest, p, nil},
+		{"no data", (&packet{typ: typeAck}).marshal(magicReply), magicReply,
+			&packet{version: protocolVersion, typ: typeAck, data: []byte{}}, nil},
+		{"other version", other, magicRequest,
+			&packet{version: protocolVersion + 1, typ: p.typ, flags: p.flags, session: p.session,
+				seq: p.seq, ack: p.ack, sack: p.sack, window: p.window, data: p.data}, errOtherVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePacket(tt.b, tt.magic)
+			if err != tt.wantErr {
+				t.Fatalf("parsePacket() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parsePacket() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePacketRejects(t *testing.T) {
+	b := (&packet{typ: typeAck}).marshal(magicRequest)
+	tests := []struct {
+		name  string
+		b     []byte
+		magic uint32
+	}{
+		{"empty", nil, magicRequest},
+		{"short", b[:headerSize-1], magicRequest},
+		{"ordinary ping", []byte("abcdefghijklmnopqrstuvwxyz0123456789"), magicRequest},
+		{"other magic", b, magicReply},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if p, err := parsePacket(tt.b, tt.magic); err == nil || err == errOtherVersion {
+				t.Fatalf("parsePacket() = %+v, %v, want an error", p, err)
+			}
+		})
+	}
+}
+
+func TestVersionRst(t *testing.T) {
+	req := (&packet{typ: typeSyn, session: 9, data: []byte("nonce")}).marshal(magicRequest)
+	req[4] = protocolVersion + 1
+	orig := append([]byte(nil), req...)
+
+	rst := versionRst(req)
+	if !bytes.Equal(req, orig) {
+		t.Fatal("versionRst changed the request")
+	}
+	p, err := parsePacket(rst, magicReply)
+	if err != nil {
+		t.Fatalf("parsePacket(rst) error = %v", err)
+	}
+	if p.typ != typeRst {
+		t.Fatalf("rst type = %d, want %d", p.typ, typeRst)
+	}
+	// the rest is echoed back as it was
+	if !bytes.Equal(rst[6:], req[6:]) {
+		t.Fatalf("rst body = %x, want %x", rst[6:], req[6:])
+	}
+}
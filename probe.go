@@ -0,0 +1,148 @@
+package icmpnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// PayloadSize is the largest echo payload, tunnel header included,
+// that a client tries when it connects. The largest size that makes
+// the round trip to the server is used by both sides of the connection.
+// It is the default of DialConfig.PayloadSize.
+var PayloadSize = 1472
+
+const (
+	minPayloadSize = 548 // fits in the minimum IPv4 datagram of 576 bytes
+	maxPayloadSize = 65507
+	maxPacketSize  = 65536
+	probeRounds    = 3
+)
+
+// payload sizes filling common path MTUs without fragmentation
+var probeSizes = []int{1472, 1452, 1372, 1232, 1024, minPayloadSize}
+
+// candidateSizes returns the probe sizes not larger than max, largest first.
+func candidateSizes(max int) []int {
+	sizes := []int{max}
+	for _, size := range probeSizes {
+		if size < max {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
+
+// newProbe builds a probe for payload size, padded to padTo bytes.
+// A probe that is not padded tells the server the size chosen by the client.
+func newProbe(size, padTo int) *packet {
+	n := padTo - headerSize
+	if n < 2 {
+		n = 2
+	}
+	data := make([]byte, n)
+	binary.BigEndian.PutUint16(data, uint16(size))
+	return &packet{typ: typeProbe, data: data}
+}
+
+// probePayloadSize sends a probe of every candidate size at once,
+// picks the largest one echoed back by the server
+// and tells the server to use the same size.
+func (ic *icmpConn) probePayloadSize() error {
+	sizes := candidateSizes(ic.payloadSize)
+	for round := 0; round < probeRounds; round++ {
+		probes := make(map[uint16]int, len(sizes))
+		start := time.Now()
+		for _, size := range sizes {
+			seq, err := ic.sendRequest(newProbe(size, size))
+			if err != nil {
+				return err
+			}
+			probes[seq] = size
+		}
+
+		best := 0
+		timeout := time.After(ic.rtt.rto())
+	wait:
+		for best != sizes[0] {
+			select {
+			case msg := <-ic.readCh:
+				body, ok := ic.received(msg)
+				if !ok {
+					continue
+				}
+				size, found := probes[uint16(body.Seq)]
+				if !found {
+					continue
+				}
+				if best == 0 {
+					// larger probes were sent along with this one,
+					// they should not take much longer
+					rtt := time.Since(start)
+					ic.rtt.sample(rtt)
+					timeout = time.After(rtt + 10*time.Millisecond)
+				}
+				if size > best {
+					best = size
+				}
+			case <-timeout:
+				break wait
+			case <-ic.wclosedCh:
+				return io.ErrClosedPipe
+			case <-ic.failCh:
+				return ic.err
+			}
+		}
+		if best > 0 {
+			ic.setPayloadSize(best)
+			return ic.commitPayloadSize()
+		}
+		ic.rtt.onTimeout()
+	}
+	return fmt.Errorf("payload size probe: %w", ErrNoReply)
+}
+
+func (ic *icmpConn) commitPayloadSize() error {
+	for i := 0; i < probeRounds; i++ {
+		seq, err := ic.sendRequest(newProbe(ic.payloadSize, 0))
+		if err != nil {
+			return err
+		}
+		p, err := ic.awaitReply(ic.rtt.rto(), func(s uint16, _ *packet) bool {
+			return s == seq
+		})
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			return nil
+		}
+		ic.rtt.onTimeout()
+	}
+	return fmt.Errorf("payload size commit: %w", ErrNoReply)
+}
+
+// answerProbe echoes a probe back unchanged but for its magic,
+// and adopts the payload size chosen by the client.
+// Probes larger than the configured maximum are not answered.
+func (ic *icmpConn) answerProbe(msg *icmp.Message, p *packet) error {
+	if len(p.data) < 2 || headerSize+len(p.data) > ic.cfg.maxPayloadSize {
+		return nil
+	}
+	size := int(binary.BigEndian.Uint16(p.data))
+	if headerSize+len(p.data) < size && size >= minPayloadSize && size <= ic.cfg.maxPayloadSize {
+		ic.setPayloadSize(size)
+		ic.cfg.log("%v: payload size %d", ic, size)
+	}
+	msg.Type = ic.family.echoReply
+	msg.Body.(*icmp.Echo).Data = p.marshal(magicReply)
+	return ic.sendMsg(msg)
+}
+
+func (ic *icmpConn) setPayloadSize(size int) {
+	ic.payloadSize = size
+	ic.count(func(stats *Stats) { stats.PayloadSize = size })
+}
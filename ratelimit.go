@@ -0,0 +1,108 @@
+package icmpnet
+
+import (
+	"time"
+)
+
+// tokenBucket allows rate events per second on average,
+// and up to burst at once after a quiet period.
+// It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.Before(b.last) {
+		// now was taken before the bucket was created
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow takes a token if there is one.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// idle reports whether the bucket is full again,
+// in which case it can be dropped and created anew when needed.
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// most keys a rateLimiter tracks at once, so that a flood
+// of spoofed sources can not grow it without bound
+const maxBuckets = 1 << 16
+
+// rateLimiter keeps a token bucket per key, for as long as it is in use.
+// Keys beyond maxBuckets are not allowed until the others go idle.
+// It is not safe for concurrent use.
+type rateLimiter struct {
+	rate      float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	if now.Sub(l.lastSweep) > 10*time.Second {
+		l.sweep(now)
+	}
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= maxBuckets && now.Sub(l.lastSweep) > time.Second {
+			l.sweep(now)
+		}
+		if len(l.buckets) >= maxBuckets {
+			return false
+		}
+		b = newTokenBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	return b.allow(now)
+}
+
+// sweep drops the idle buckets, so that sources come and gone
+// do not pile up.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.idle(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
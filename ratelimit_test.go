@@ -0,0 +1,104 @@
+package icmpnet
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	type step struct {
+		after time.Duration // since the previous step
+		want  bool
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{"burst then empty", 1, 3, []step{
+			{0, true}, {0, true}, {0, true}, {0, false},
+		}},
+		{"refill", 2, 1, []step{
+			{0, true}, {0, false}, {250 * time.Millisecond, false}, {250 * time.Millisecond, true},
+		}},
+		{"refill up to burst", 10, 2, []step{
+			{0, true}, {0, true}, {time.Minute, true}, {0, true}, {0, false},
+		}},
+		{"zero burst is one", 1, 0, []step{
+			{0, true}, {0, false}, {time.Second, true},
+		}},
+		{"slow rate", 0.5, 1, []step{
+			{0, true}, {time.Second, false}, {time.Second, true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate, tt.burst)
+			now := b.last
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				if got := b.allow(now); got != s.want {
+					t.Fatalf("step %d: allow() = %v, want %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketIdle(t *testing.T) {
+	b := newTokenBucket(1, 2)
+	now := b.last
+	if !b.idle(now) {
+		t.Fatal("new bucket not idle")
+	}
+	b.allow(now)
+	if b.idle(now.Add(time.Second / 2)) {
+		t.Fatal("bucket idle before it refilled")
+	}
+	if !b.idle(now.Add(time.Second)) {
+		t.Fatal("bucket not idle once refilled")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	now := l.lastSweep
+	if !l.allow("a", now) || l.allow("a", now) {
+		t.Fatal("key not limited")
+	}
+	if !l.allow("b", now) {
+		t.Fatal("keys not limited apart")
+	}
+	// the idle buckets go with the next sweep
+	l.allow("a", now.Add(11*time.Second))
+	if len(l.buckets) != 1 {
+		t.Fatalf("%d buckets after a sweep, want 1", len(l.buckets))
+	}
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	now := l.lastSweep
+	for i := 0; i < maxBuckets; i++ {
+		l.allow(fmt.Sprint(i), now)
+	}
+	if l.allow("new", now) {
+		t.Fatal("new key allowed beyond maxBuckets")
+	}
+	if len(l.buckets) != maxBuckets {
+		t.Fatalf("%d buckets, want %d", len(l.buckets), maxBuckets)
+	}
+	// known keys are still limited as usual
+	if !l.allow("0", now.Add(2*time.Second)) {
+		t.Fatal("known key refused")
+	}
+	// room is made for new keys once the others go idle
+	if !l.allow("new", now.Add(3*time.Second)) {
+		t.Fatal("new key refused once the others went idle")
+	}
+	if len(l.buckets) != 1 {
+		t.Fatalf("%d buckets after a sweep, want 1", len(l.buckets))
+	}
+}
@@ -0,0 +1,191 @@
+package icmpnet
+
+import (
+	"context"
+	"crypto/aes"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnState is the state of the connection of a Reconnector.
+type ConnState int
+
+// states of a Reconnector
+const (
+	StateConnecting   ConnState = iota // dialing the server
+	StateConnected                     // a session is open, or resumed
+	StateResuming                      // no reply from the server, trying to resume the session
+	StateDisconnected                  // the session is lost or the dial failed, dialing again after a backoff
+)
+
+var stateNames = [...]string{"connecting", "connected", "resuming", "disconnected"}
+
+func (s ConnState) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[s]
+}
+
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+)
+
+// Reconnector keeps a connection to a server, dialing a new session
+// with backoff whenever the last one is lost.
+// A session that resumes after an outage, see DialConfig.ResumeTimeout,
+// goes on as if nothing happened but for the state changes.
+// A new session is handed to the handler given to Run, the data
+// in flight in the lost one is lost with it.
+type Reconnector struct {
+	// Dialer is the config used to dial, the zero config if nil.
+	Dialer *DialConfig
+
+	// Address is the host name or IP address of the server.
+	Address string
+
+	// MinBackoff is how long to wait before dialing again after
+	// a failure, doubled with each failure in a row up to MaxBackoff.
+	// The defaults are 1 second and 1 minute.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnState, if not nil, is called on each change of state, with
+	// the error that caused it for StateDisconnected.
+	// Calls are not concurrent.
+	OnState func(state ConnState, err error)
+
+	mtx     sync.Mutex
+	session int // counts sessions, so that late calls of an old one are ignored
+}
+
+// Run dials the server and calls handle with each new session, until
+// handle returns nil, ctx is done or the server refuses the client
+// for good, as with ErrWrongKey. handle should return an error
+// once conn fails, the connection is then closed and dialed again.
+// Run closes the connection when ctx is done, for handle to return.
+func (r *Reconnector) Run(ctx context.Context, handle func(conn net.Conn) error) error {
+	dc := r.Dialer
+	if dc == nil {
+		dc = &DialConfig{}
+	}
+	backoff := r.minBackoff()
+	for {
+		session := r.newSession()
+		r.setState(session, StateConnecting, nil)
+		cfg := dc.connConfig()
+		cfg.onState = func(state ConnState) {
+			r.setState(session, state, nil)
+		}
+		conn, err := dc.dialContext(ctx, r.Address, cfg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if permanent(err) {
+				return err
+			}
+			r.setState(session, StateDisconnected, err)
+			if !sleepContext(ctx, jitter(backoff)) {
+				return ctx.Err()
+			}
+			if backoff *= 2; backoff > r.maxBackoff() {
+				backoff = r.maxBackoff()
+			}
+			continue
+		}
+		backoff = r.minBackoff()
+		r.setState(session, StateConnected, nil)
+
+		err = r.serve(ctx, conn, handle)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r.setState(session, StateDisconnected, err)
+		if !sleepContext(ctx, jitter(backoff)) {
+			return ctx.Err()
+		}
+	}
+}
+
+// serve runs handle on conn, closing conn once it returns or ctx is done.
+func (r *Reconnector) serve(ctx context.Context, conn net.Conn, handle func(conn net.Conn) error) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	err := handle(conn)
+	conn.Close()
+	return err
+}
+
+func (r *Reconnector) newSession() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.session++
+	return r.session
+}
+
+// setState calls OnState, unless session is over.
+func (r *Reconnector) setState(session int, state ConnState, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if session != r.session || r.OnState == nil {
+		return
+	}
+	r.OnState(state, err)
+}
+
+func (r *Reconnector) minBackoff() time.Duration {
+	if r.MinBackoff > 0 {
+		return r.MinBackoff
+	}
+	return defaultMinBackoff
+}
+
+func (r *Reconnector) maxBackoff() time.Duration {
+	if r.MaxBackoff >= r.minBackoff() {
+		return r.MaxBackoff
+	}
+	if defaultMaxBackoff < r.minBackoff() {
+		return r.minBackoff()
+	}
+	return defaultMaxBackoff
+}
+
+// permanent reports whether dialing again can not help.
+func permanent(err error) bool {
+	var keyErr aes.KeySizeError
+	return errors.Is(err, ErrWrongKey) || errors.Is(err, ErrVersionMismatch) ||
+		errors.As(err, &keyErr)
+}
+
+// jitter spreads d over [d/2, d], so that clients cut off together
+// do not all come back at once.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleepContext waits for d, it returns false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/rpc"
@@ -51,3 +52,11 @@ func (c *Client) InfoVersion() (string, error) {
 	var vInfo string
 	return vInfo, c.rpcClient.Call(MethodInfo+".Version", &struct{}{}, &vInfo)
 }
+
+// ConnLost reports whether err is due to the connection failing,
+// rather than to the file or the server, so that the call may be
+// tried again on a new connection.
+func ConnLost(err error) bool {
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
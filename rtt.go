@@ -0,0 +1,103 @@
+package icmpnet
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	initialRTO = time.Second
+	minRTO     = 200 * time.Millisecond
+	maxRTO     = 60 * time.Second
+	maxBackoff = 6
+)
+
+// rttEstimator keeps the smoothed round trip time and its variance
+// (Jacobson/Karels) and derives the retransmission timeout from them.
+// It is safe for concurrent use, so that Stats can read it.
+type rttEstimator struct {
+	mtx         sync.Mutex
+	srtt        time.Duration
+	rttvar      time.Duration
+	backoff     uint
+	lastBackoff time.Time
+}
+
+func newRTTEstimator() *rttEstimator {
+	return new(rttEstimator)
+}
+
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.srtt == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.backoff = 0
+}
+
+// rto returns the current retransmission timeout including backoff.
+func (e *rttEstimator) rto() time.Duration {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.rtoLocked()
+}
+
+// baseRTO returns the retransmission timeout without backoff,
+// which only tells how long the path takes to answer.
+func (e *rttEstimator) baseRTO() time.Duration {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.baseRTOLocked()
+}
+
+func (e *rttEstimator) baseRTOLocked() time.Duration {
+	rto := initialRTO
+	if e.srtt != 0 {
+		rto = e.srtt + 4*e.rttvar
+	}
+	if rto < minRTO {
+		rto = minRTO
+	}
+	return rto
+}
+
+func (e *rttEstimator) rtoLocked() time.Duration {
+	rto := e.baseRTOLocked() << e.backoff
+	if rto > maxRTO {
+		rto = maxRTO
+	}
+	return rto
+}
+
+// onTimeout doubles the timeout, at most once per timeout period,
+// so that a burst of segments lost together counts as a single loss.
+func (e *rttEstimator) onTimeout() {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(e.lastBackoff) < e.rtoLocked() {
+		return
+	}
+	e.lastBackoff = now
+	if e.backoff < maxBackoff {
+		e.backoff++
+	}
+}
+
+func (e *rttEstimator) smoothed() time.Duration {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.srtt
+}
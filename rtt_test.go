@@ -0,0 +1,42 @@
+package icmpnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []time.Duration
+		timeouts int
+		base     time.Duration
+		rto      time.Duration
+	}{
+		{"no sample", nil, 0, initialRTO, initialRTO},
+		{"first sample", []time.Duration{100 * time.Millisecond}, 0, 300 * time.Millisecond, 300 * time.Millisecond},
+		{"fast path", []time.Duration{time.Millisecond}, 0, minRTO, minRTO},
+		{"backoff", []time.Duration{100 * time.Millisecond}, 3, 300 * time.Millisecond, 2400 * time.Millisecond},
+		{"backoff bounds", []time.Duration{time.Second}, 20, 3 * time.Second, maxRTO},
+		{"steady path", []time.Duration{100 * time.Millisecond, 100 * time.Millisecond}, 0,
+			250 * time.Millisecond, 250 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newRTTEstimator()
+			for _, rtt := range tt.samples {
+				e.sample(rtt)
+			}
+			for i := 0; i < tt.timeouts; i++ {
+				e.lastBackoff = time.Time{} // a timeout period went by
+				e.onTimeout()
+			}
+			if got := e.baseRTO(); got != tt.base {
+				t.Errorf("baseRTO() = %v, want %v", got, tt.base)
+			}
+			if got := e.rto(); got != tt.rto {
+				t.Errorf("rto() = %v, want %v", got, tt.rto)
+			}
+		})
+	}
+}
@@ -11,13 +11,22 @@ import (
 )
 
 type secureConn struct {
-	bufferConn
-	baseConn net.Conn
-	aesgcm   cipher.AEAD
-	aesKey   []byte
+	layerConn
+	aesgcm cipher.AEAD
+	aesKey []byte
+
+	// how long the rest of a message may take to arrive,
+	// the base connection may be resuming meanwhile
+	readTimeout func() time.Duration
+}
+
+// quietConn is a connection that tells how long its peer
+// may stay quiet before it fails, see icmpConn.quietTimeout.
+type quietConn interface {
+	quietTimeout() time.Duration
 }
 
-func newSecureConn(baseConn net.Conn, aesKey []byte) (*secureConn, error) {
+func newSecureConn(baseConn net.Conn, aesKey []byte, cfg *connConfig) (*secureConn, error) {
 	block, err := aes.NewCipher(aesKey)
 	if err != nil {
 		return nil, err
@@ -29,21 +38,25 @@ func newSecureConn(baseConn net.Conn, aesKey []byte) (*secureConn, error) {
 	}
 
 	sc := &secureConn{
-		bufferConn: *newBufferConn(baseConn.LocalAddr(), baseConn.RemoteAddr()),
-		baseConn:   baseConn,
-		aesgcm:     aesgcm,
-		aesKey:     aesKey,
+		layerConn: *newLayerConn(baseConn, cfg),
+		aesgcm:    aesgcm,
+		aesKey:    aesKey,
+
+		readTimeout: func() time.Duration {
+			return cfg.idleTimeout + cfg.resumeTimeout
+		},
+	}
+	if qc, ok := baseConn.(quietConn); ok {
+		// raised with the timeouts of the base connection on slow paths
+		sc.readTimeout = qc.quietTimeout
 	}
 	go sc.readLoop()
-	go sc.writeLoop()
+	go sc.writeLoop(sc.writeMsg, nil)
 	return sc, nil
 }
 
 func (sc *secureConn) readLoop() {
-	defer func() {
-		sc.Close()
-		sc.baseConn.Close()
-	}()
+	defer sc.setEOF()
 
 	for {
 		sizeB := make([]byte, 4)
@@ -53,17 +66,22 @@ func (sc *secureConn) readLoop() {
 
 		size := binary.BigEndian.Uint32(sizeB)
 		if size > 35000 {
+			sc.baseConn.Close()
 			return
 		}
 		emsg := make([]byte, size)
-		if err := sc.readFullTimeout(emsg, 5*time.Second); err != nil {
+		if err := sc.readFullTimeout(emsg, sc.readTimeout()); err != nil {
+			sc.baseConn.Close()
 			return
 		}
 		msg, err := sc.aesgcm.Open(nil, sc.aesKey[:12], emsg, nil)
 		if err != nil {
+			sc.baseConn.Close()
+			return
+		}
+		if !sc.deliver(msg) {
 			return
 		}
-		sc.writeInBuf(msg)
 	}
 }
 
@@ -83,34 +101,17 @@ func (sc *secureConn) readFullTimeout(b []byte, d time.Duration) error {
 	}
 }
 
-func (sc *secureConn) writeLoop() {
-	defer func() {
-		sc.Close()
-		sc.baseConn.Close()
-	}()
+// writeMsg encrypts msg and writes it to the base connection.
+func (sc *secureConn) writeMsg(msg []byte) error {
+	emsg := sc.aesgcm.Seal(nil, sc.aesKey[:12], msg, nil)
+	size := uint32(len(emsg))
 
-	buf := make([]byte, 32768)
-	for {
-		n, _ := sc.readOutBuf(buf)
-		if n == 0 {
-			time.Sleep(time.Millisecond)
-			continue
-		}
-		msg := buf[:n]
+	sizeB := make([]byte, 4)
+	binary.BigEndian.PutUint32(sizeB, size)
 
-		emsg := sc.aesgcm.Seal(nil, sc.aesKey[:12], msg, nil)
-		size := uint32(len(emsg))
-
-		sizeB := make([]byte, 4)
-		binary.BigEndian.PutUint32(sizeB, size)
-
-		_, err := sc.baseConn.Write(sizeB)
-		if err != nil {
-			return
-		}
-		_, err = sc.baseConn.Write(emsg)
-		if err != nil {
-			return
-		}
+	if _, err := sc.baseConn.Write(sizeB); err != nil {
+		return err
 	}
+	_, err := sc.baseConn.Write(emsg)
+	return err
 }
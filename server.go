@@ -5,46 +5,134 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 )
 
 type server struct {
+	droppedPackets uint64 // first for 64-bit alignment of atomic operations
+
 	aesKey []byte
-	pconn  *icmp.PacketConn
+	cfg    *connConfig
+	pconns map[*icmpFamily]net.PacketConn
 
-	connPool  map[string]*icmpConn
+	connPool  map[uint32]*icmpConn
+	synPool   map[string]*icmpConn
 	cpMtx     sync.RWMutex
 	newConnCh chan net.Conn
 
+	answerPings map[*icmpFamily]bool // the kernel ignores the pings
+	restoreEcho func()               // restores the kernel settings on Close
+
+	ipSessions map[string]int // sessions by client address
+
+	acceptMtx  sync.Mutex // serializes the opening of sessions
+	synLimiter *rateLimiter
+
+	rstMtx     sync.Mutex
+	rstLimiter *tokenBucket // see rstRate
+
+	maxSessions      int
+	maxSessionsPerIP int
+	packetRate       float64
+	packetBurst      int
+
+	// counters guarded by acceptMtx
+	rejectedBacklog   uint64
+	rejectedLimit     uint64
+	droppedHandshakes uint64
+
 	closedCh chan struct{}
 }
 
 // Listen creates a new icmp listener (server).
+// It serves both ICMP and ICMPv6, or either one if the other is not available.
 // If aesKey is nil, encryption is disabled.
 func Listen(aesKey []byte) (net.Listener, error) {
+	lc := &ListenConfig{AESKey: aesKey}
+	return lc.Listen()
+}
+
+// Listen creates a new icmp listener (server) with the options of lc.
+// Every listener on a host reads every echo request sent to it,
+// and a client takes the first to accept its handshake:
+// listeners sharing a host should each have a key of their own.
+func (lc *ListenConfig) Listen() (net.Listener, error) {
 	// verify aesKey
-	if aesKey != nil {
-		if _, err := aes.NewCipher(aesKey); err != nil {
+	if lc.AESKey != nil {
+		if _, err := aes.NewCipher(lc.AESKey); err != nil {
 			return nil, err
 		}
 	}
-
-	pconn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
-	if err != nil {
+	pconns := make(map[*icmpFamily]net.PacketConn)
+	var err error
+	for _, f := range families {
+		pconn, e := icmp.ListenPacket(f.network, f.address)
+		if e != nil {
+			err = e
+			continue
+		}
+		pconns[f] = pconn
+	}
+	if len(pconns) == 0 {
 		return nil, err
 	}
-	s := &server{
-		aesKey:    aesKey,
-		pconn:     pconn,
-		connPool:  make(map[string]*icmpConn),
-		newConnCh: make(chan net.Conn, 100),
+	s := lc.newServer(pconns)
+	if lc.DisableKernelEcho {
+		if s.restoreEcho, err = disableKernelEcho(); err != nil {
+			for _, pconn := range pconns {
+				pconn.Close()
+			}
+			return nil, err
+		}
 	}
-	go s.mainLoop()
+	s.start()
 	return s, nil
 }
 
+// newServer returns a server reading pconns, the sockets of its families.
+func (lc *ListenConfig) newServer(pconns map[*icmpFamily]net.PacketConn) *server {
+	backlog := lc.AcceptBacklog
+	if backlog <= 0 {
+		backlog = defaultAcceptBacklog
+	}
+
+	s := &server{
+		aesKey:    lc.AESKey,
+		cfg:       lc.connConfig(),
+		pconns:    pconns,
+		connPool:  make(map[uint32]*icmpConn),
+		synPool:   make(map[string]*icmpConn),
+		newConnCh: make(chan net.Conn, backlog),
+		closedCh:  make(chan struct{}),
+
+		ipSessions:       make(map[string]int),
+		maxSessions:      lc.MaxSessions,
+		maxSessionsPerIP: lc.MaxSessionsPerIP,
+		packetRate:       lc.PacketRate,
+		packetBurst:      burstOf(lc.PacketRate, lc.PacketBurst),
+		rstLimiter:       newTokenBucket(rstRate, rstRate),
+	}
+	if lc.SessionRate > 0 {
+		s.synLimiter = newRateLimiter(lc.SessionRate, burstOf(lc.SessionRate, lc.SessionBurst))
+	}
+	return s
+}
+
+// start serves the families of the server,
+// once the kernel settings are made.
+func (s *server) start() {
+	s.answerPings = make(map[*icmpFamily]bool)
+	for f := range s.pconns {
+		s.answerPings[f] = !kernelEchoes(f)
+	}
+	for f, pconn := range s.pconns {
+		go s.mainLoop(f, pconn)
+	}
+}
+
 // Accept implements net.Listener
 func (s *server) Accept() (net.Conn, error) {
 	select {
@@ -61,57 +149,111 @@ func (s *server) Close() error {
 	case <-s.closedCh:
 		return fmt.Errorf("closedCh")
 	default:
+		// give the kernel its pings back first, should a peer hold
+		// its connection for long
+		if s.restoreEcho != nil {
+			s.restoreEcho()
+		}
+		// close the connections while their peers' acks can still be read
+		var wg sync.WaitGroup
+		for _, conn := range s.allConns() {
+			wg.Add(1)
+			go func(conn *icmpConn) {
+				defer wg.Done()
+				conn.Close()
+			}(conn)
+		}
+		wg.Wait()
 		close(s.closedCh)
-		conns := s.allConns()
-		for _, conn := range conns {
-			conn.Close()
+		for _, pconn := range s.pconns {
+			pconn.Close()
 		}
 		return nil
 	}
 }
 
-// Addr implements net.Listener
+// Addr implements net.Listener.
+// It returns the ICMP address if both ICMP and ICMPv6 are served.
 func (s *server) Addr() net.Addr {
-	return s.pconn.LocalAddr()
+	if _, ok := s.pconns[familyV4]; ok {
+		return s.localAddr(familyV4)
+	}
+	return s.localAddr(familyV6)
 }
 
-func (s *server) mainLoop() {
-	buf := make([]byte, 5000)
+func (s *server) mainLoop(f *icmpFamily, pconn net.PacketConn) {
+	buf := make([]byte, maxPacketSize)
 	for {
 		select {
 		case <-s.closedCh:
 			return
 		default:
-			n, addr, err := s.pconn.ReadFrom(buf)
+			n, addr, err := pconn.ReadFrom(buf)
 			if err != nil {
-				panic(err)
+				select {
+				case <-s.closedCh:
+				default:
+					s.cfg.log("icmpnet: %s: %v", f.network, err)
+				}
+				return
 			}
-			msg, err := icmp.ParseMessage(1, buf[:n])
+			msg, err := icmp.ParseMessage(f.protocol, buf[:n])
 			if err != nil {
 				continue
 			}
-			if msg.Type != ipv4.ICMPTypeEcho {
+			if msg.Type != f.echoRequest {
 				continue
 			}
 			if body, ok := msg.Body.(*icmp.Echo); ok {
-				conn := s.loadConn(icmpConnKey(addr, body.ID))
+				p, err := parsePacket(body.Data, magicRequest)
+				if err == errOtherVersion {
+					s.rejectVersion(msg, p, addr)
+					continue
+				}
+				if err != nil {
+					// an ordinary ping
+					if s.answerPings[f] {
+						msg.Type = f.echoReply
+						s.sendMsg(msg, addr)
+					}
+					continue
+				}
+				if p.typ == typeSyn {
+					s.openSession(msg, p, addr)
+					continue
+				}
+				conn := s.loadConn(p.session)
 				if conn == nil {
-					conn = newICMPServerConn(s, body.ID, addr)
-					s.storeConn(conn.String(), conn)
-					s.onConnect(conn)
+					// a session closed, or one of another listener
+					// on the host, which sees the same requests:
+					// the client times out on its own
+					continue
+				}
+				if !addrIP(addr).Equal(addrIP(conn.RemoteAddr())) && !s.migrateSession(msg, conn, p, addr) {
+					continue
+				}
+				if conn.limiter != nil && !conn.limiter.allow(time.Now()) {
+					atomic.AddUint64(&s.droppedPackets, 1)
+					continue
+				}
+				select {
+				case conn.readCh <- msg:
+				default:
+					// a session slow to read its packets
+					// must not hold up the others
+					atomic.AddUint64(&s.droppedPackets, 1)
 				}
-				conn.readCh <- msg
 			}
 		}
 	}
 }
 
-func (s *server) localAddr() net.Addr {
-	return s.pconn.LocalAddr()
+func (s *server) localAddr(f *icmpFamily) net.Addr {
+	return s.pconns[f].LocalAddr()
 }
 
 func (s *server) onConnClose(conn *icmpConn) {
-	s.deleteConn(conn.String())
+	s.deleteConn(conn)
 }
 
 func (s *server) sendMsg(msg *icmp.Message, addr net.Addr) error {
@@ -119,24 +261,19 @@ func (s *server) sendMsg(msg *icmp.Message, addr net.Addr) error {
 	if err != nil {
 		return err
 	}
-	_, err = s.pconn.WriteTo(b, addr)
+	_, err = s.pconns[familyOf(addr)].WriteTo(b, addr)
 	return err
 }
 
 func (s *server) onConnect(conn *icmpConn) {
-	if s.aesKey == nil {
-		s.emitNewConn(conn)
-	} else {
-		sconn, _ := newSecureConn(conn, s.aesKey)
-		s.emitNewConn(sconn)
-	}
+	wconn, _ := wrapConn(conn, s.aesKey, s.cfg)
+	s.emitNewConn(wconn)
 }
 
+// emitNewConn queues conn for Accept,
+// openSession made sure there is room for it.
 func (s *server) emitNewConn(conn net.Conn) {
-	select {
-	case s.newConnCh <- conn:
-	default:
-	}
+	s.newConnCh <- conn
 }
 
 func (s *server) allConns() []*icmpConn {
@@ -149,20 +286,66 @@ func (s *server) allConns() []*icmpConn {
 	return ret
 }
 
-func (s *server) loadConn(key string) *icmpConn {
+func (s *server) loadConn(session uint32) *icmpConn {
 	s.cpMtx.RLock()
 	defer s.cpMtx.RUnlock()
-	return s.connPool[key]
+	return s.connPool[session]
 }
 
-func (s *server) storeConn(key string, conn *icmpConn) {
+func (s *server) loadSyn(key string) *icmpConn {
+	s.cpMtx.RLock()
+	defer s.cpMtx.RUnlock()
+	return s.synPool[key]
+}
+
+// newConn creates and stores the connection of a new session,
+// with an id not used by any other session.
+func (s *server) newConn(addr net.Addr, clientNonce []byte, options uint8) *icmpConn {
+	s.cpMtx.Lock()
+	defer s.cpMtx.Unlock()
+	session := newSessionID()
+	for session == 0 || s.connPool[session] != nil {
+		session = newSessionID()
+	}
+	conn := newICMPServerConn(s, session, clientNonce, s.aesKey, addr, s.cfg)
+	conn.options = options
+	if s.packetRate > 0 {
+		conn.limiter = newTokenBucket(s.packetRate, s.packetBurst)
+	}
+	s.connPool[session] = conn
+	s.synPool[synKey(addr, clientNonce)] = conn
+	s.ipSessions[addrIP(addr).String()]++
+	return conn
+}
+
+// moveConn moves the session of conn to addr, the new address of the client.
+func (s *server) moveConn(conn *icmpConn, addr net.Addr) {
 	s.cpMtx.Lock()
 	defer s.cpMtx.Unlock()
-	s.connPool[key] = conn
+	if s.connPool[conn.session] != conn {
+		return
+	}
+	// the handshake is long over
+	delete(s.synPool, synKey(conn.RemoteAddr(), conn.clientNonce))
+	ip := addrIP(conn.RemoteAddr()).String()
+	if s.ipSessions[ip]--; s.ipSessions[ip] <= 0 {
+		delete(s.ipSessions, ip)
+	}
+	s.ipSessions[addrIP(addr).String()]++
+	conn.migrations++
+	conn.setRemoteAddr(addr)
 }
 
-func (s *server) deleteConn(key string) {
+func (s *server) deleteConn(conn *icmpConn) {
 	s.cpMtx.Lock()
 	defer s.cpMtx.Unlock()
-	delete(s.connPool, key)
+	if s.connPool[conn.session] != conn {
+		return
+	}
+	delete(s.connPool, conn.session)
+	delete(s.synPool, synKey(conn.RemoteAddr(), conn.clientNonce))
+	ip := addrIP(conn.RemoteAddr()).String()
+	if s.ipSessions[ip]--; s.ipSessions[ip] <= 0 {
+		delete(s.ipSessions, ip)
+	}
 }
@@ -0,0 +1,290 @@
+package icmpnet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// A client opens a session with a SYN carrying a random nonce,
+// a key check (zeros without encryption), the options it asks for
+// and its Version.
+// The server answers with a SYN carrying the session id it allocated,
+// the client nonce, a nonce of its own, the options it grants among
+// those asked and its Version, or with a RST
+// carrying the client nonce, the reason it rejects the session
+// and its Version. A SYN of another protocol version is rejected
+// before it is read, see packet.go.
+// Every packet after the handshake carries the session id,
+// which the server binds to the client's address.
+
+const (
+	nonceSize       = 8
+	keyCheckSize    = 16
+	handshakeRounds = 5
+)
+
+// session options, one bit each
+const (
+	optCompress uint8 = 1 << iota // the stream is compressed, see compress_conn.go
+)
+
+// rstRate is the number of RSTs a listener sends per second at most,
+// whatever its limits. A RST answers a packet whose source may be
+// spoofed, and the listener must not reflect a flood of them.
+// A client rejected without a RST times out retrying.
+const rstRate = 100
+
+// reasons carried by a RST rejecting a handshake
+const (
+	rstUnknown uint8 = iota
+	rstWrongKey
+	rstBacklog
+	rstMaxSessions
+	rstMaxSessionsPerIP
+)
+
+func newNonce() []byte {
+	b := make([]byte, nonceSize)
+	rand.Read(b)
+	return b
+}
+
+func newSessionID() uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+func synKey(addr net.Addr, nonce []byte) string {
+	return addrIP(addr).String() + "/" + hex.EncodeToString(nonce)
+}
+
+// keyCheck proves to the server that the client holds the same aesKey,
+// without revealing it. It is all zeros if aesKey is nil.
+func keyCheck(aesKey, nonce []byte) []byte {
+	if aesKey == nil {
+		return make([]byte, keyCheckSize)
+	}
+	mac := hmac.New(sha256.New, aesKey)
+	mac.Write([]byte("icmpnet key check"))
+	mac.Write(nonce)
+	return mac.Sum(nil)[:keyCheckSize]
+}
+
+// rstError returns the error for a RST answering a SYN.
+func rstError(p *packet) error {
+	if p.version != protocolVersion {
+		return fmt.Errorf("%w: server speaks version %d, client %d",
+			ErrVersionMismatch, p.version, protocolVersion)
+	}
+	if len(p.data) > nonceSize {
+		return reasonError(p.data[nonceSize])
+	}
+	return ErrReset
+}
+
+// reasonError returns the error for the reason a session is rejected.
+func reasonError(reason uint8) error {
+	switch reason {
+	case rstWrongKey:
+		return ErrWrongKey
+	case rstBacklog, rstMaxSessions:
+		return ErrServerBusy
+	case rstMaxSessionsPerIP:
+		return ErrTooManySessions
+	}
+	return ErrReset
+}
+
+// handshake opens the session of a client connection.
+func (ic *icmpConn) handshake() error {
+	syn := make([]byte, 0, nonceSize+keyCheckSize+1+len(Version))
+	syn = append(syn, ic.clientNonce...)
+	syn = append(syn, keyCheck(ic.aesKey, ic.clientNonce)...)
+	syn = append(syn, ic.cfg.options)
+	syn = append(syn, Version...)
+	for round := 0; round < handshakeRounds; round++ {
+		start := time.Now()
+		seq, err := ic.sendRequest(&packet{typ: typeSyn, data: syn})
+		if err != nil {
+			return err
+		}
+		var (
+			replySeq uint16
+			rst      *packet
+		)
+		// another listener on the host sees the SYN too, and may reject it
+		// before the one dialed answers: a RST holds until the end of the round
+		p, err := ic.awaitReply(ic.rtt.rto(), func(s uint16, p *packet) bool {
+			if !bytes.HasPrefix(p.data, ic.clientNonce) {
+				return false
+			}
+			if p.typ == typeRst {
+				rst = p
+				return false
+			}
+			replySeq = s
+			return p.typ == typeSyn
+		})
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			if rst != nil {
+				return rstError(rst)
+			}
+			ic.rtt.onTimeout()
+			continue
+		}
+		if len(p.data) < 2*nonceSize+1 {
+			return fmt.Errorf("invalid handshake reply")
+		}
+		if replySeq == seq {
+			ic.rtt.sample(time.Since(start))
+		}
+		ic.session = p.session
+		ic.serverNonce = p.data[nonceSize : 2*nonceSize]
+		ic.ticket = sessionTicket(ic.aesKey, ic.clientNonce, ic.serverNonce)
+		ic.options = p.data[2*nonceSize] & ic.cfg.options
+		ic.cfg.log("%v: server version %s", ic, p.data[2*nonceSize+1:])
+		return nil
+	}
+	return ErrNoReply
+}
+
+// awaitReply returns the first packet read for which match returns true,
+// or nil if there is none before timeout.
+func (ic *icmpConn) awaitReply(timeout time.Duration, match func(seq uint16, p *packet) bool) (*packet, error) {
+	timeoutC := time.After(timeout)
+	for {
+		select {
+		case msg := <-ic.readCh:
+			body, ok := ic.received(msg)
+			if !ok {
+				continue
+			}
+			p, err := parsePacket(body.Data, magicReply)
+			if err != nil && err != errOtherVersion {
+				continue
+			}
+			if match(uint16(body.Seq), p) {
+				return p, nil
+			}
+		case <-timeoutC:
+			return nil, nil
+		case <-ic.wclosedCh:
+			return nil, io.ErrClosedPipe
+		case <-ic.failCh:
+			return nil, ic.err
+		}
+	}
+}
+
+// openSession answers a SYN, allocating a new session
+// unless the SYN is a retransmission for a session already opened.
+// A new session is rejected if the accept backlog is full
+// or the limits of the listener are reached.
+func (s *server) openSession(msg *icmp.Message, p *packet, addr net.Addr) {
+	if len(p.data) < nonceSize+keyCheckSize+1 {
+		return
+	}
+	s.acceptMtx.Lock()
+	defer s.acceptMtx.Unlock()
+	if s.synLimiter != nil && !s.synLimiter.allow(addrIP(addr).String(), time.Now()) {
+		s.droppedHandshakes++
+		return
+	}
+	nonce := p.data[:nonceSize]
+	if !hmac.Equal(p.data[nonceSize:nonceSize+keyCheckSize], keyCheck(s.aesKey, nonce)) {
+		s.rejectSession(msg, nonce, rstWrongKey, addr)
+		return
+	}
+	conn := s.loadSyn(synKey(addr, nonce))
+	if conn == nil {
+		if reason, ok := s.admit(addr); !ok {
+			s.rejectSession(msg, nonce, reason, addr)
+			return
+		}
+		conn = s.newConn(addr, nonce, p.data[nonceSize+keyCheckSize]&s.cfg.options)
+		s.cfg.log("%v: open, client version %s", conn, p.data[nonceSize+keyCheckSize+1:])
+		s.onConnect(conn)
+	}
+	data := make([]byte, 0, 2*nonceSize+1+len(Version))
+	data = append(data, conn.clientNonce...)
+	data = append(data, conn.serverNonce...)
+	data = append(data, conn.options)
+	data = append(data, Version...)
+	s.reply(msg, &packet{typ: typeSyn, session: conn.session, data: data}, addr)
+}
+
+// admit checks a new session from addr against the accept backlog
+// and the session limits, and returns the reason to reject it if any.
+func (s *server) admit(addr net.Addr) (uint8, bool) {
+	if len(s.newConnCh) == cap(s.newConnCh) {
+		s.rejectedBacklog++
+		return rstBacklog, false
+	}
+	s.cpMtx.RLock()
+	defer s.cpMtx.RUnlock()
+	if s.maxSessions > 0 && len(s.connPool) >= s.maxSessions {
+		s.rejectedLimit++
+		return rstMaxSessions, false
+	}
+	if s.maxSessionsPerIP > 0 && s.ipSessions[addrIP(addr).String()] >= s.maxSessionsPerIP {
+		s.rejectedLimit++
+		return rstMaxSessionsPerIP, false
+	}
+	return 0, true
+}
+
+// rejectSession answers a SYN with a RST telling the client why.
+func (s *server) rejectSession(msg *icmp.Message, nonce []byte, reason uint8, addr net.Addr) {
+	data := make([]byte, 0, nonceSize+1+len(Version))
+	data = append(data, nonce...)
+	data = append(data, reason)
+	data = append(data, Version...)
+	if s.allowRst() {
+		s.cfg.log("%v: handshake rejected: %v", addr, reasonError(reason))
+		s.reply(msg, &packet{typ: typeRst, data: data}, addr)
+	}
+}
+
+// rejectVersion answers a packet of another protocol version,
+// whose layout is unknown but for the fields that never move,
+// by echoing it back as a RST of this version.
+func (s *server) rejectVersion(msg *icmp.Message, p *packet, addr net.Addr) {
+	if p.typ == typeSyn {
+		s.cfg.log("%v: handshake rejected: client speaks version %d, server %d",
+			addr, p.version, protocolVersion)
+	}
+	if !s.allowRst() {
+		return
+	}
+	body := msg.Body.(*icmp.Echo)
+	msg.Type = familyOf(addr).echoReply
+	body.Data = versionRst(body.Data)
+	s.sendMsg(msg, addr)
+}
+
+// allowRst reports whether a RST may be sent now, see rstRate.
+func (s *server) allowRst() bool {
+	s.rstMtx.Lock()
+	defer s.rstMtx.Unlock()
+	return s.rstLimiter.allow(time.Now())
+}
+
+func (s *server) reply(msg *icmp.Message, p *packet, addr net.Addr) error {
+	msg.Type = familyOf(addr).echoReply
+	msg.Body.(*icmp.Echo).Data = p.marshal(magicReply)
+	return s.sendMsg(msg, addr)
+}
@@ -0,0 +1,139 @@
+package icmpnet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+func TestHandshake(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	tests := []struct {
+		name string
+		lc   ListenConfig
+		dc   DialConfig
+	}{
+		{"plain", ListenConfig{}, DialConfig{}},
+		{"encrypted", ListenConfig{AESKey: key}, DialConfig{AESKey: key}},
+		{"compressed", ListenConfig{Compress: true}, DialConfig{Compress: true}},
+		{"compression refused", ListenConfig{}, DialConfig{Compress: true}},
+		{"encrypted and compressed", ListenConfig{AESKey: key, Compress: true},
+			DialConfig{AESKey: key, Compress: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, cconn, sconn := memPair(t, &tt.lc, &tt.dc)
+			for _, c := range []struct{ from, to io.ReadWriter }{{cconn, sconn}, {sconn, cconn}} {
+				if _, err := c.from.Write([]byte("hello")); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				b := make([]byte, 5)
+				if _, err := io.ReadFull(c.to, b); err != nil || string(b) != "hello" {
+					t.Fatalf("read %q, %v, want hello", b, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	otherKey := bytes.Repeat([]byte{2}, 16)
+	tests := []struct {
+		name     string
+		lc       ListenConfig
+		dc       DialConfig
+		sessions int // open before
+		want     error
+	}{
+		{"wrong key", ListenConfig{AESKey: key}, DialConfig{AESKey: otherKey}, 0, ErrWrongKey},
+		{"no key", ListenConfig{AESKey: key}, DialConfig{}, 0, ErrWrongKey},
+		{"backlog", ListenConfig{AcceptBacklog: 1}, DialConfig{}, 1, ErrServerBusy},
+		{"max sessions", ListenConfig{MaxSessions: 2}, DialConfig{}, 2, ErrServerBusy},
+		{"max sessions per ip", ListenConfig{MaxSessionsPerIP: 1}, DialConfig{}, 1, ErrTooManySessions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newMemNet()
+			s := memListen(t, n, &tt.lc)
+			var conns []io.Closer
+			defer func() { closeAll(conns...) }()
+			for i := 0; i < tt.sessions; i++ {
+				conn, err := memDial(n, memClientIP, &tt.dc)
+				if err != nil {
+					t.Fatalf("dial %d: %v", i, err)
+				}
+				conns = append(conns, conn)
+				if tt.lc.AcceptBacklog == 0 {
+					sconn, _ := s.Accept()
+					conns = append(conns, sconn)
+				}
+			}
+			conn, err := memDial(n, memClientIP, &tt.dc)
+			if err == nil {
+				conn.Close()
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("dial error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenersSharingHost(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 16)
+	otherKey := bytes.Repeat([]byte{2}, 16)
+	n := newMemNet()
+	s := memListen(t, n, &ListenConfig{AESKey: key})
+	// it sees the requests of s, rejects their handshakes
+	// and knows none of their sessions
+	memListen(t, n, &ListenConfig{AESKey: otherKey})
+
+	for i := 0; i < 5; i++ {
+		cconn, err := memDial(n, memClientIP, &DialConfig{AESKey: key})
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		sconn, _ := s.Accept()
+		for _, c := range []struct{ from, to io.ReadWriter }{{cconn, sconn}, {sconn, cconn}} {
+			if _, err := c.from.Write([]byte("hello")); err != nil {
+				t.Fatalf("dial %d: write: %v", i, err)
+			}
+			b := make([]byte, 5)
+			if _, err := io.ReadFull(c.to, b); err != nil || string(b) != "hello" {
+				t.Fatalf("dial %d: read %q, %v, want hello", i, b, err)
+			}
+		}
+		closeAll(cconn, sconn)
+	}
+}
+
+func TestRstRate(t *testing.T) {
+	n := newMemNet()
+	memListen(t, n, &ListenConfig{AESKey: bytes.Repeat([]byte{1}, 16)})
+	sock := n.socket(memClientIP)
+	defer sock.Close()
+
+	// a flood of handshakes with the wrong key, from a spoofed source
+	server := &net.IPAddr{IP: net.ParseIP(memServerIP)}
+	otherKey := bytes.Repeat([]byte{2}, 16)
+	for i := 0; i < 3*rstRate; i++ {
+		nonce := newNonce()
+		syn := append(append(nonce, keyCheck(otherKey, nonce)...), 0)
+		msg := &icmp.Message{
+			Type: familyV4.echoRequest,
+			Body: &icmp.Echo{ID: 1, Seq: i, Data: (&packet{typ: typeSyn, data: syn}).marshal(magicRequest)},
+		}
+		b, _ := msg.Marshal(nil)
+		sock.WriteTo(b, server)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if rsts := len(sock.inCh); rsts == 0 || rsts > rstRate+rstRate/2 {
+		t.Fatalf("%d RSTs sent for %d handshakes, want at most about %d", rsts, 3*rstRate, rstRate)
+	}
+}
@@ -0,0 +1,153 @@
+package icmpnet
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// Stats are the counters of a connection since it was opened.
+type Stats struct {
+	PacketsSent     uint64 // echo messages sent
+	PacketsReceived uint64 // echo messages received
+	BytesSent       uint64 // echo payload bytes sent, tunnel header included
+	BytesReceived   uint64 // echo payload bytes received, tunnel header included
+	Retransmits     uint64 // data segments sent again
+	FastRetransmits uint64 // retransmits of segments found lost by the sacks, without a timeout
+	Duplicates      uint64 // data segments received again and dropped
+	IdlePolls       uint64 // requests or replies sent without a data segment
+
+	RTT              time.Duration // smoothed round trip time, zero before a sample
+	RTO              time.Duration // current retransmission timeout
+	CongestionWindow int           // data segments allowed in flight
+	PayloadSize      int           // echo payload size in use
+	SinceLastPacket  time.Duration // time since the last echo message received
+
+	Compressed         bool    // the stream is compressed, see DialConfig.Compress
+	CompressionRatio   float64 // bytes written by the application per byte sent, once compressed
+	DecompressionRatio float64 // bytes read by the application per byte received compressed
+}
+
+// GetStats returns the stats of a connection returned by Connect, Accept
+// or a DialConfig, encrypted or compressed or not.
+func GetStats(conn net.Conn) (Stats, bool) {
+	if sc, ok := conn.(interface{ Stats() Stats }); ok {
+		return sc.Stats(), true
+	}
+	return Stats{}, false
+}
+
+// ListenerStats are the counters of a listener since it was created.
+type ListenerStats struct {
+	Sessions          int    // sessions open, accepted or not
+	Parked            int    // sessions whose client is gone quiet, waiting for it to resume
+	Pending           int    // sessions waiting for Accept
+	RejectedBacklog   uint64 // sessions rejected because the accept backlog was full
+	RejectedLimit     uint64 // sessions rejected by MaxSessions or MaxSessionsPerIP
+	DroppedHandshakes uint64 // handshakes dropped by SessionRate
+	DroppedPackets    uint64 // packets dropped by PacketRate or a full ReadQueueSize
+}
+
+// GetListenerStats returns the stats of a listener returned by Listen
+// or a ListenConfig.
+func GetListenerStats(ln net.Listener) (ListenerStats, bool) {
+	if s, ok := ln.(interface{ Stats() ListenerStats }); ok {
+		return s.Stats(), true
+	}
+	return ListenerStats{}, false
+}
+
+// Stats returns the counters of the listener.
+func (s *server) Stats() ListenerStats {
+	s.acceptMtx.Lock()
+	defer s.acceptMtx.Unlock()
+	s.cpMtx.RLock()
+	defer s.cpMtx.RUnlock()
+	parked := 0
+	for _, conn := range s.connPool {
+		if atomic.LoadInt32(&conn.parked) == 1 {
+			parked++
+		}
+	}
+	return ListenerStats{
+		Sessions:          len(s.connPool),
+		Parked:            parked,
+		Pending:           len(s.newConnCh),
+		RejectedBacklog:   s.rejectedBacklog,
+		RejectedLimit:     s.rejectedLimit,
+		DroppedHandshakes: s.droppedHandshakes,
+		DroppedPackets:    atomic.LoadUint64(&s.droppedPackets),
+	}
+}
+
+// Stats returns the counters of the connection.
+func (ic *icmpConn) Stats() Stats {
+	ic.statsMtx.Lock()
+	defer ic.statsMtx.Unlock()
+	stats := ic.stats
+	stats.RTT = ic.rtt.smoothed()
+	stats.RTO = ic.rtt.rto()
+	stats.CongestionWindow = ic.cc.window()
+	if !ic.lastRecv.IsZero() {
+		stats.SinceLastPacket = time.Since(ic.lastRecv)
+	}
+	return stats
+}
+
+// Stats returns the counters of the underlying connection.
+func (sc *secureConn) Stats() Stats {
+	stats, _ := GetStats(sc.baseConn)
+	return stats
+}
+
+// Stats returns the counters of the underlying connection
+// and the compression ratios.
+func (cc *compressConn) Stats() Stats {
+	stats, _ := GetStats(cc.baseConn)
+	stats.Compressed = true
+	stats.CompressionRatio = ratio(atomic.LoadUint64(&cc.written), atomic.LoadUint64(&cc.sent))
+	stats.DecompressionRatio = ratio(atomic.LoadUint64(&cc.read), atomic.LoadUint64(&cc.received))
+	return stats
+}
+
+// ratio returns a/b, or zero if b is.
+func ratio(a, b uint64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+func (ic *icmpConn) count(f func(stats *Stats)) {
+	ic.statsMtx.Lock()
+	defer ic.statsMtx.Unlock()
+	f(&ic.stats)
+}
+
+// received counts a message read from readCh and returns its echo body.
+func (ic *icmpConn) received(msg *icmp.Message) (*icmp.Echo, bool) {
+	body, ok := msg.Body.(*icmp.Echo)
+	if !ok {
+		return nil, false
+	}
+	ic.statsMtx.Lock()
+	defer ic.statsMtx.Unlock()
+	ic.stats.PacketsReceived++
+	ic.stats.BytesReceived += uint64(len(body.Data))
+	ic.lastRecv = time.Now()
+	return body, true
+}
+
+// sendMsg sends msg to the peer and counts it.
+func (ic *icmpConn) sendMsg(msg *icmp.Message) error {
+	err := ic.host.sendMsg(msg, ic.RemoteAddr())
+	if err == nil {
+		ic.count(func(stats *Stats) {
+			stats.PacketsSent++
+			stats.BytesSent += uint64(len(msg.Body.(*icmp.Echo).Data))
+		})
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package icmpnet
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// sysctls making the kernel ignore echo requests
+var echoIgnorePaths = map[*icmpFamily]string{
+	familyV4: "/proc/sys/net/ipv4/icmp_echo_ignore_all",
+	familyV6: "/proc/sys/net/ipv6/icmp/echo_ignore_all",
+}
+
+// kernelEchoes reports whether the kernel answers the pings of family.
+func kernelEchoes(f *icmpFamily) bool {
+	b, err := ioutil.ReadFile(echoIgnorePaths[f])
+	if err != nil {
+		return true
+	}
+	return strings.TrimSpace(string(b)) == "0"
+}
+
+// disableKernelEcho makes the kernel ignore echo requests,
+// and returns a function restoring the previous settings.
+// A family the kernel has no setting for is skipped.
+func disableKernelEcho() (func(), error) {
+	saved := make(map[string][]byte)
+	restore := func() {
+		for path, old := range saved {
+			ioutil.WriteFile(path, old, 0644)
+		}
+	}
+	for _, f := range families {
+		path := echoIgnorePaths[f]
+		old, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte("1\n"), 0644)
+		}
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		saved[path] = old
+	}
+	return restore, nil
+}
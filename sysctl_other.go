@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package icmpnet
+
+import (
+	"fmt"
+)
+
+// kernelEchoes reports whether the kernel answers the pings of family,
+// which is assumed where it can not be checked.
+func kernelEchoes(f *icmpFamily) bool {
+	return true
+}
+
+func disableKernelEcho() (func(), error) {
+	return nil, fmt.Errorf("disabling kernel echo replies is only supported on linux")
+}
@@ -0,0 +1,238 @@
+package icmpnet
+
+import (
+	"time"
+)
+
+// number of data segments allowed in flight in each direction,
+// no more than a sack bitmap can acknowledge
+const windowSize = 32
+
+// seqBefore reports whether segment a comes before segment b.
+// Sequence numbers use serial number arithmetic (RFC 1982),
+// so that they can wrap around on long-lived sessions.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+type segment struct {
+	seq     uint32
+	data    []byte
+	fin     bool
+	sentAt  time.Time
+	sent    int
+	sentNum uint64 // transmission number of the last send
+	sacked  bool
+	lost    bool // to be sent again without waiting for the timeout
+}
+
+// sendWindow holds the segments sent but not yet acknowledged by the peer.
+type sendWindow struct {
+	size       int
+	peerWindow int // segments the peer has room for, from its last packet
+	nextSeq    uint32
+	segs       []*segment
+	sends      uint64 // transmissions so far
+}
+
+func newSendWindow(size int) *sendWindow {
+	return &sendWindow{
+		size:       size,
+		peerWindow: size,
+		nextSeq:    1,
+		segs:       make([]*segment, 0, size),
+	}
+}
+
+// full reports whether no more segments may be pushed,
+// either in flight or beyond the room advertised by the peer.
+func (w *sendWindow) full() bool {
+	return len(w.segs) >= w.size || len(w.segs) >= w.peerWindow
+}
+
+func (w *sendWindow) empty() bool {
+	return len(w.segs) == 0
+}
+
+func (w *sendWindow) push(data []byte) *segment {
+	seg := &segment{
+		seq:  w.nextSeq,
+		data: append([]byte(nil), data...),
+	}
+	w.nextSeq++
+	w.segs = append(w.segs, seg)
+	return seg
+}
+
+// pushFin queues the segment telling the peer that nothing follows,
+// and reports whether there was room for it. It carries no data,
+// so it does not wait for room at the peer.
+func (w *sendWindow) pushFin() bool {
+	if len(w.segs) >= w.size {
+		return false
+	}
+	seg := w.push(nil)
+	seg.fin = true
+	return true
+}
+
+// ack drops the segments covered by the cumulative ack and marks the ones
+// selectively acknowledged. It returns the round trip time measured on the
+// newest acknowledged segment that was transmitted only once, or zero,
+// and the number of segments newly acknowledged.
+func (w *sendWindow) ack(ack, sack uint32) (time.Duration, int) {
+	var sentAt time.Time
+	acked := 0
+	measure := func(seg *segment) {
+		if seg.sent > 0 && !seg.sacked {
+			acked++
+		}
+		if seg.sent == 1 && !seg.sacked && seg.sentAt.After(sentAt) {
+			sentAt = seg.sentAt
+		}
+	}
+	i := 0
+	for i < len(w.segs) && seqBefore(w.segs[i].seq, ack) {
+		measure(w.segs[i])
+		i++
+	}
+	w.segs = w.segs[i:]
+	for _, seg := range w.segs {
+		d := seg.seq - ack - 1
+		if d < 32 && sack&(1<<d) != 0 {
+			measure(seg)
+			seg.sacked = true
+		}
+	}
+	if sentAt.IsZero() {
+		return 0, acked
+	}
+	return time.Since(sentAt), acked
+}
+
+// markLost marks the segments in flight that a segment sent after them
+// was selectively acknowledged before, once they were sent more than
+// a round trip ago plus a quarter of it for reordering (RACK, RFC 8985),
+// and reports whether there were any.
+func (w *sendWindow) markLost(now time.Time, srtt time.Duration) bool {
+	found := false
+	for i, seg := range w.segs {
+		if seg.sent == 0 || seg.sacked || seg.lost || now.Sub(seg.sentAt) <= srtt+srtt/4 {
+			continue
+		}
+		for _, later := range w.segs[i+1:] {
+			if later.sacked && later.sentNum > seg.sentNum {
+				seg.lost = true
+				found = true
+				break
+			}
+		}
+	}
+	return found
+}
+
+// sentEnd returns the segment after the last one sent.
+func (w *sendWindow) sentEnd() uint32 {
+	for i := len(w.segs) - 1; i >= 0; i-- {
+		if w.segs[i].sent > 0 {
+			return w.segs[i].seq + 1
+		}
+	}
+	if len(w.segs) > 0 {
+		return w.segs[0].seq
+	}
+	return w.nextSeq
+}
+
+// inFlight returns the number of segments sent and neither acknowledged
+// nor found lost.
+func (w *sendWindow) inFlight() int {
+	n := 0
+	for _, seg := range w.segs {
+		if seg.sent > 0 && !seg.sacked && !seg.lost {
+			n++
+		}
+	}
+	return n
+}
+
+// due returns the first segment that was found lost,
+// or was sent longer than timeout ago without being acknowledged,
+// or was never sent if fewer than cwnd segments are in flight.
+func (w *sendWindow) due(now time.Time, timeout time.Duration, cwnd int) *segment {
+	room := w.inFlight() < cwnd
+	for _, seg := range w.segs {
+		if seg.sacked {
+			continue
+		}
+		if seg.lost || seg.sent > 0 && now.Sub(seg.sentAt) >= timeout {
+			return seg
+		}
+		if seg.sent == 0 && room {
+			return seg
+		}
+	}
+	return nil
+}
+
+// sent records a transmission of seg.
+func (w *sendWindow) sent(seg *segment, now time.Time) {
+	w.sends++
+	seg.sent++
+	seg.sentNum = w.sends
+	seg.sentAt = now
+	seg.lost = false
+}
+
+// recvWindow reorders the segments received from the peer.
+type recvWindow struct {
+	size int
+	next uint32
+	segs map[uint32]*packet
+	fin  bool // the peer's FIN segment was received in order
+}
+
+func newRecvWindow(size int) *recvWindow {
+	return &recvWindow{
+		size: size,
+		next: 1,
+		segs: make(map[uint32]*packet, size),
+	}
+}
+
+// receive stores the segment and returns the data now deliverable in order.
+// ok is false if the segment is a duplicate or outside the window.
+func (w *recvWindow) receive(p *packet) (ready [][]byte, ok bool) {
+	if w.fin || p.seq-w.next >= uint32(w.size) {
+		// before next if the difference wrapped around
+		return nil, false
+	}
+	if _, found := w.segs[p.seq]; found {
+		return nil, false
+	}
+	w.segs[p.seq] = p
+	for !w.fin {
+		p, found := w.segs[w.next]
+		if !found {
+			break
+		}
+		delete(w.segs, w.next)
+		w.next++
+		if p.hasFlag(flagFin) {
+			w.fin = true
+		} else {
+			ready = append(ready, p.data)
+		}
+	}
+	return ready, true
+}
+
+func (w *recvWindow) ackFields() (ack, sack uint32) {
+	for seq := range w.segs {
+		d := seq - w.next - 1
+		if d < 32 {
+			sack |= 1 << d
+		}
+	}
+	return w.next, sack
+}
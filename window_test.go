@@ -0,0 +1,258 @@
+package icmpnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeqBefore(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{0xfffffff0, 0, true},
+		{0, 0xfffffff0, false},
+		{0xffffffff, 1, true},
+		{1, 0xffffffff, false},
+		{0, 0x7fffffff, true},
+		{0x7fffffff, 0, false},
+	}
+	for _, tt := range tests {
+		if got := seqBefore(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqBefore(%#x, %#x) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRecvWindowReceive(t *testing.T) {
+	type step struct {
+		seq   uint32
+		fin   bool
+		ready int // segments delivered
+		ok    bool
+		ack   uint32
+		sack  uint32
+	}
+	tests := []struct {
+		name  string
+		next  uint32
+		steps []step
+	}{
+		{"in order", 1, []step{
+			{seq: 1, ready: 1, ok: true, ack: 2},
+			{seq: 2, ready: 1, ok: true, ack: 3},
+		}},
+		{"out of order", 1, []step{
+			{seq: 3, ok: true, ack: 1, sack: 1 << 1},
+			{seq: 2, ok: true, ack: 1, sack: 1<<0 | 1<<1},
+			{seq: 1, ready: 3, ok: true, ack: 4},
+		}},
+		{"duplicate", 1, []step{
+			{seq: 2, ok: true, ack: 1, sack: 1},
+			{seq: 2, ok: false, ack: 1, sack: 1},
+			{seq: 1, ready: 2, ok: true, ack: 3},
+			{seq: 1, ok: false, ack: 3},
+		}},
+		{"beyond the window", 1, []step{
+			{seq: 1 + windowSize, ok: false, ack: 1},
+			{seq: windowSize, ok: true, ack: 1, sack: 1 << (windowSize - 2)},
+		}},
+		{"wrap past 0", 0xfffffffe, []step{
+			{seq: 0xfffffffe, ready: 1, ok: true, ack: 0xffffffff},
+			{seq: 0xffffffff, ready: 1, ok: true, ack: 0},
+			{seq: 0, ready: 1, ok: true, ack: 1},
+		}},
+		{"stale duplicate from before the wrap", 0xfffffffe, []step{
+			{seq: 0xfffffffe, ready: 1, ok: true, ack: 0xffffffff},
+			{seq: 0xffffffff, ready: 1, ok: true, ack: 0},
+			{seq: 0, ready: 1, ok: true, ack: 1},
+			{seq: 0xffffffff, ok: false, ack: 1},
+			{seq: 0xfffffff0, ok: false, ack: 1},
+		}},
+		{"sacks across the wrap", 0xfffffffe, []step{
+			{seq: 0, ok: true, ack: 0xfffffffe, sack: 1 << 1},
+			{seq: 2, ok: true, ack: 0xfffffffe, sack: 1<<1 | 1<<3},
+			{seq: 0xfffffffe, ready: 1, ok: true, ack: 0xffffffff, sack: 1<<0 | 1<<2},
+			{seq: 0xffffffff, ready: 2, ok: true, ack: 1, sack: 1 << 0},
+		}},
+		{"fin", 1, []step{
+			{seq: 2, ok: true, ack: 1, sack: 1},
+			{seq: 1, fin: true, ok: true, ack: 2, sack: 0},
+			{seq: 3, ok: false, ack: 2},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newRecvWindow(windowSize)
+			w.next = tt.next
+			for i, s := range tt.steps {
+				p := &packet{typ: typeData, seq: s.seq, data: []byte{byte(s.seq)}}
+				if s.fin {
+					p.flags = flagFin
+				}
+				ready, ok := w.receive(p)
+				if len(ready) != s.ready || ok != s.ok {
+					t.Fatalf("step %d: receive(%#x) = %d segments, %v, want %d, %v",
+						i, s.seq, len(ready), ok, s.ready, s.ok)
+				}
+				if ack, sack := w.ackFields(); ack != s.ack || sack != s.sack {
+					t.Fatalf("step %d: ackFields() = %#x, %#b, want %#x, %#b",
+						i, ack, sack, s.ack, s.sack)
+				}
+			}
+		})
+	}
+}
+
+func TestSendWindowAck(t *testing.T) {
+	type step struct {
+		ack, sack uint32
+		acked     int
+		left      int    // segments still in the window
+		sacked    uint32 // bit i set if segment i left is sacked
+	}
+	tests := []struct {
+		name  string
+		first uint32 // seq of the first segment
+		segs  int    // pushed and sent once
+		steps []step
+	}{
+		{"cumulative", 1, 4, []step{
+			{ack: 3, acked: 2, left: 2},
+			{ack: 5, acked: 2, left: 0},
+		}},
+		{"duplicate ack", 1, 2, []step{
+			{ack: 2, acked: 1, left: 1},
+			{ack: 2, acked: 0, left: 1},
+			{ack: 1, acked: 0, left: 1},
+		}},
+		{"sack then ack", 1, 4, []step{
+			{ack: 1, sack: 1<<0 | 1<<2, acked: 2, left: 4, sacked: 1<<1 | 1<<3},
+			{ack: 1, sack: 1 << 0, acked: 0, left: 4, sacked: 1<<1 | 1<<3},
+			{ack: 5, acked: 2, left: 0},
+		}},
+		{"wrap past 0", 0xfffffffe, 4, []step{
+			{ack: 0, acked: 2, left: 2},
+			{ack: 2, acked: 2, left: 0},
+		}},
+		{"sacks across the wrap", 0xfffffffe, 4, []step{
+			{ack: 0xffffffff, sack: 1 << 1, acked: 2, left: 3, sacked: 1 << 2},
+			{ack: 0xffffffff, sack: 1<<0 | 1<<1, acked: 1, left: 3, sacked: 1<<1 | 1<<2},
+			{ack: 2, acked: 1, left: 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newSendWindow(windowSize)
+			w.nextSeq = tt.first
+			now := time.Now()
+			for i := 0; i < tt.segs; i++ {
+				w.sent(w.push([]byte{byte(i)}), now)
+			}
+			for i, s := range tt.steps {
+				_, acked := w.ack(s.ack, s.sack)
+				if acked != s.acked || len(w.segs) != s.left {
+					t.Fatalf("step %d: ack(%#x, %#b) acked %d, left %d, want %d, %d",
+						i, s.ack, s.sack, acked, len(w.segs), s.acked, s.left)
+				}
+				var sacked uint32
+				for j, seg := range w.segs {
+					if seg.sacked {
+						sacked |= 1 << j
+					}
+				}
+				if sacked != s.sacked {
+					t.Fatalf("step %d: sacked %#b, want %#b", i, sacked, s.sacked)
+				}
+			}
+		})
+	}
+}
+
+func TestSendWindowAckRTT(t *testing.T) {
+	now := time.Now()
+	w := newSendWindow(windowSize)
+	seg := w.push([]byte{1})
+	w.sent(seg, now.Add(-2*time.Second))
+	w.sent(seg, now.Add(-time.Second))
+	// a segment sent again can not tell which send was acked
+	if rtt, acked := w.ack(2, 0); rtt != 0 || acked != 1 {
+		t.Errorf("ack of a retransmitted segment = %v, %d, want 0, 1", rtt, acked)
+	}
+
+	w = newSendWindow(windowSize)
+	w.sent(w.push([]byte{1}), now.Add(-time.Second))
+	w.sent(w.push([]byte{2}), now.Add(-time.Second))
+	if rtt, _ := w.ack(1, 1); rtt < time.Second {
+		t.Errorf("rtt of a sacked segment = %v, want at least 1s", rtt)
+	}
+	// measured once only
+	if rtt, _ := w.ack(3, 0); rtt < time.Second {
+		t.Errorf("rtt of the first segment = %v, want at least 1s", rtt)
+	}
+	if rtt, acked := w.ack(3, 0); rtt != 0 || acked != 0 {
+		t.Errorf("duplicate ack = %v, %d, want 0, 0", rtt, acked)
+	}
+}
+
+func TestSendWindowFull(t *testing.T) {
+	tests := []struct {
+		name       string
+		segs       int
+		peerWindow int
+		want       bool
+	}{
+		{"empty", 0, windowSize, false},
+		{"room", windowSize - 1, windowSize, false},
+		{"window", windowSize, windowSize, true},
+		{"peer window", 2, 2, true},
+		{"room at the peer", 1, 2, false},
+		{"closed peer window", 0, 0, true},
+		{"shrunk peer window", 3, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newSendWindow(windowSize)
+			for i := 0; i < tt.segs; i++ {
+				w.push([]byte{byte(i)})
+			}
+			w.peerWindow = tt.peerWindow
+			if got := w.full(); got != tt.want {
+				t.Fatalf("full() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendWindowPushFin(t *testing.T) {
+	tests := []struct {
+		name       string
+		segs       int
+		peerWindow int
+		want       bool
+	}{
+		{"empty", 0, windowSize, true},
+		{"room", windowSize - 1, windowSize, true},
+		{"full window", windowSize, windowSize, false},
+		{"closed peer window", 0, 0, true},
+		{"full peer window", 3, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newSendWindow(windowSize)
+			for i := 0; i < tt.segs; i++ {
+				w.push([]byte{byte(i)})
+			}
+			w.peerWindow = tt.peerWindow
+			if got := w.pushFin(); got != tt.want {
+				t.Fatalf("pushFin() = %v, want %v", got, tt.want)
+			}
+			if n := len(w.segs); tt.want && (n != tt.segs+1 || !w.segs[n-1].fin) {
+				t.Fatalf("no FIN segment after pushFin()")
+			}
+		})
+	}
+}